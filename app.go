@@ -0,0 +1,226 @@
+package leaf
+
+import (
+	"context"
+	"errors"
+	"github.com/name5566/leaf/cluster"
+	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/console"
+	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/module"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// an App is one Leaf server with its own modules, config, logger, console
+// and cluster state, several Apps can run in one process
+// the modules get the logger, the cluster, the console and the reloader of
+// the App (see module.Env), the chanrpc servers, go and timer log to the
+// logger of the package log
+// conf.LenStackBuf and conf.DeadlockDetection apply to every App and the
+// chanrpc console command lists the servers of every App
+type App struct {
+	conf     *conf.Config
+	logger   *log.Logger
+	modules  *module.Manager
+	cluster  *cluster.Cluster
+	console  *console.Console
+	reloader *conf.Reloader
+	// the App of leaf.Run exports its logger
+	std        bool
+	prevLogger *log.Logger
+	started    bool
+}
+
+// the settings of the package conf are used if c is nil
+func NewApp(c *conf.Config) *App {
+	if c == nil {
+		c = conf.Global()
+	}
+
+	app := new(App)
+	app.conf = c
+	app.modules = module.NewManager(c)
+	app.cluster = cluster.New(c)
+	app.console = console.New(c)
+	app.reloader = conf.NewReloader(c)
+	app.console.RegisterFunc("module", "state and health of the modules", app.modules.Command)
+	app.init()
+	return app
+}
+
+func (app *App) init() {
+	app.console.RegisterFunc("reload", "reloads the config file", app.commandReload)
+	app.reloader.Subscribe(conf.SubscriberFunc(app.onConfigReload))
+}
+
+func (app *App) commandReload(args []string) string {
+	err := app.reloader.Reload()
+	if err != nil {
+		return err.Error()
+	}
+	return "reloaded " + app.reloader.Config().ConfigFile
+}
+
+func (app *App) onConfigReload(c *conf.Config, old *conf.Config) {
+	app.Logger().Release("config reloaded from %v", c.ConfigFile)
+
+	if c.LogLevel == old.LogLevel || c.LogLevel == "" {
+		return
+	}
+	if app.logger == nil && !app.std {
+		return
+	}
+	err := app.Logger().SetLevel(c.LogLevel)
+	if err != nil {
+		app.Logger().Error("set log level error: %v", err)
+	}
+}
+
+// you must call the function before calling Start
+func (app *App) Register(mods ...module.Module) {
+	for _, mi := range mods {
+		app.modules.Register(mi)
+	}
+}
+
+func (app *App) Modules() *module.Manager {
+	return app.modules
+}
+
+func (app *App) Cluster() *cluster.Cluster {
+	return app.cluster
+}
+
+func (app *App) Console() *console.Console {
+	return app.console
+}
+
+// the modules subscribe to the reloader to receive the reloaded config
+func (app *App) Reloader() *conf.Reloader {
+	return app.reloader
+}
+
+// the logger of the process if LogLevel is empty
+func (app *App) Logger() *log.Logger {
+	if app.logger != nil {
+		return app.logger
+	}
+	return log.Default()
+}
+
+// returns an error for a bad config or if the App cannot listen, nothing is
+// left running then
+func (app *App) Start() error {
+	if app.started {
+		return errors.New("Leaf is already started")
+	}
+
+	// logger
+	if app.conf.LogLevel != "" {
+		logger, err := log.New(app.conf.LogLevel, app.conf.LogPath, app.conf.LogFlag)
+		if err != nil {
+			return err
+		}
+		app.logger = logger
+		if app.std {
+			app.prevLogger = log.Default()
+			log.Export(logger)
+		}
+	}
+
+	app.Logger().Release("Leaf %v starting up", version)
+
+	app.cluster.SetLogger(app.logger)
+	app.console.SetLogger(app.logger)
+	app.modules.SetEnv(&module.Env{
+		Conf:     app.conf,
+		Logger:   app.logger,
+		Cluster:  app.cluster,
+		Console:  app.console,
+		Reloader: app.reloader,
+	})
+
+	// module
+	err := app.modules.Init()
+	if err != nil {
+		app.closeLogger()
+		return err
+	}
+
+	// cluster
+	err = app.cluster.Init()
+	if err != nil {
+		app.modules.Destroy()
+		app.closeLogger()
+		return err
+	}
+
+	// console
+	err = app.console.Init()
+	if err != nil {
+		app.cluster.Destroy()
+		app.modules.Destroy()
+		app.closeLogger()
+		return err
+	}
+
+	// reload
+	if app.conf.ConfigFile != "" && app.conf.ReloadInterval > 0 {
+		app.reloader.Watch(app.conf.ReloadInterval, func(err error) {
+			app.Logger().Error("reload config error: %v", err)
+		})
+	}
+
+	app.started = true
+	return nil
+}
+
+// returns an error if a module is not closed before ctx is done
+func (app *App) Stop(ctx context.Context) error {
+	if !app.started {
+		return errors.New("Leaf is not started")
+	}
+	app.started = false
+
+	app.reloader.Close()
+	app.modules.Drain()
+	app.console.Destroy()
+	app.cluster.Destroy()
+	err := app.modules.DestroyContext(ctx)
+	app.closeLogger()
+	return err
+}
+
+func (app *App) closeLogger() {
+	if app.logger == nil {
+		return
+	}
+	if app.prevLogger != nil {
+		log.Export(app.prevLogger)
+		app.prevLogger = nil
+	}
+	app.logger.Close()
+	app.logger = nil
+}
+
+// starts the App and stops it on a signal or an escalation
+func (app *App) Run() {
+	err := app.Start()
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(c)
+	select {
+	case sig := <-c:
+		app.Logger().Release("Leaf closing down (signal: %v)", sig)
+	case err := <-app.modules.Escalation():
+		app.Logger().Release("Leaf closing down (%v)", err)
+	}
+
+	app.Stop(context.Background())
+}
@@ -0,0 +1,247 @@
+package leaf
+
+import (
+	"context"
+	"errors"
+	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/gate"
+	"github.com/name5566/leaf/module"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// a module built on a skeleton
+type skeletonModule struct {
+	*module.Skeleton
+	name string
+}
+
+func newSkeletonModule(name string) *skeletonModule {
+	s := &module.Skeleton{Name: name}
+	s.Init()
+	return &skeletonModule{Skeleton: s, name: name}
+}
+
+func (m *skeletonModule) Name() string {
+	return m.name
+}
+
+func (m *skeletonModule) OnInit() {
+	m.RegisterCommand("echo", "echoes the arguments", func(args []interface{}) interface{} {
+		return strings.Join(args[0].([]string), " ")
+	})
+}
+
+func (m *skeletonModule) OnDestroy() {}
+
+// a module whose Run returns at once
+type crashModule struct {
+	name string
+}
+
+func (m *crashModule) Name() string {
+	return m.name
+}
+
+func (m *crashModule) OnInit()                {}
+func (m *crashModule) OnDestroy()             {}
+func (m *crashModule) Run(closeSig chan bool) {}
+
+// the content of the log files in dir
+func readLogs(t *testing.T, dir string) string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs string
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs += string(b)
+	}
+	return logs
+}
+
+func TestTwoApps(t *testing.T) {
+	type node struct {
+		app  *App
+		sm   *skeletonModule
+		gate *gate.Gate
+		logs string
+	}
+	var nodes []*node
+	var seed string
+	for _, name := range []string{"a", "b"} {
+		c := conf.New()
+		c.LogLevel = "debug"
+		c.LogPath = t.TempDir()
+		c.NodeName = name
+		c.ListenAddr = freeAddr(t)
+		c.ConnectInterval = 20 * time.Millisecond
+		c.PendingWriteNum = 100
+		if seed != "" {
+			c.ConnAddrs = []string{seed}
+		}
+		seed = c.ListenAddr
+
+		n := &node{app: NewApp(c), sm: newSkeletonModule("skeleton"), logs: c.LogPath}
+		n.gate = &gate.Gate{TCPAddr: freeAddr(t), MaxConnNum: 10, PendingWriteNum: 10, LenMsgLen: 2, MaxMsgLen: 4096}
+		n.app.Register(n.sm, &crashModule{name: "crash " + name}, &gateModule{n.gate})
+		nodes = append(nodes, n)
+	}
+
+	for _, n := range nodes {
+		err := n.app.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the modules use the services of their App
+	for _, n := range nodes {
+		if n.sm.Console != n.app.Console() || n.sm.Reloader != n.app.Reloader() {
+			t.Fatal("the skeleton does not use the console and the reloader of its App")
+		}
+		if n.gate.Cluster != n.app.Cluster() || n.gate.Reloader != n.app.Reloader() {
+			t.Fatal("the gate does not use the cluster and the reloader of its App")
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for nodes[0].app.Cluster().GetAgent("b") == nil || nodes[1].app.Cluster().GetAgent("a") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the nodes are not connected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for _, n := range nodes {
+		err := n.app.Stop(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each App logs to its logger
+	for i, n := range nodes {
+		name, other := "a", "b"
+		if i == 1 {
+			name, other = other, name
+		}
+		logs := readLogs(t, n.logs)
+		for _, s := range []string{"module crash " + name + " exited unexpectedly", "node " + other + " connected"} {
+			if !strings.Contains(logs, s) {
+				t.Errorf("%v: %q not logged", name, s)
+			}
+		}
+		if strings.Contains(logs, "module crash "+other) {
+			t.Errorf("%v: the module of %v logged", name, other)
+		}
+	}
+}
+
+type gateModule struct {
+	*gate.Gate
+}
+
+func (m *gateModule) Name() string {
+	return "gate"
+}
+
+func (m *gateModule) OnInit() {}
+
+// a module whose OnInit or OnStart fails
+type failModule struct {
+	crashModule
+	initPanic bool
+	startErr  error
+}
+
+func (m *failModule) OnInit() {
+	if m.initPanic {
+		panic("game over")
+	}
+}
+
+func (m *failModule) OnStart() error {
+	return m.startErr
+}
+
+func (m *failModule) Run(closeSig chan bool) {
+	<-closeSig
+}
+
+// fails if addr is in use
+func checkFree(t *testing.T, addr string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("%v is still in use: %v", addr, err)
+	}
+	ln.Close()
+}
+
+func TestStartError(t *testing.T) {
+	tests := []struct {
+		name string
+		fail *failModule
+		// the cluster cannot listen
+		bound bool
+		err   string
+	}{
+		{"OnInit panics", &failModule{initPanic: true}, false, "module fail: init: game over"},
+		{"OnStart fails", &failModule{startErr: errors.New("game over")}, false, "module fail: game over"},
+		{"cluster cannot listen", &failModule{}, true, "address already in use"},
+	}
+
+	for _, test := range tests {
+		c := conf.New()
+		c.NodeName = "a"
+		c.ListenAddr = freeAddr(t)
+		if test.bound {
+			ln, err := net.Listen("tcp", c.ListenAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+		}
+
+		app := NewApp(c)
+		g := &gate.Gate{TCPAddr: freeAddr(t), MaxConnNum: 10, PendingWriteNum: 10, LenMsgLen: 2, MaxMsgLen: 4096}
+		test.fail.name = "fail"
+		app.Register(&gateModule{g}, test.fail)
+
+		err := app.Start()
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("%v: got %v, want %v", test.name, err, test.err)
+		}
+
+		// nothing is left running
+		for _, i := range app.Modules().List() {
+			if i.State == module.StateRunning || i.State == module.StateInitializing {
+				t.Errorf("%v: module %v is %v", test.name, i.Name, i.State)
+			}
+		}
+		checkFree(t, g.TCPAddr)
+		if !test.bound {
+			checkFree(t, c.ListenAddr)
+		}
+		if err := app.Stop(context.Background()); err == nil {
+			t.Errorf("%v: stopped", test.name)
+		}
+	}
+}
@@ -1,11 +1,14 @@
 package chanrpc
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/name5566/leaf/conf"
 	"github.com/name5566/leaf/log"
 	"runtime"
+	"sync/atomic"
+	"time"
 )
 
 // one server per goroutine (goroutine not safe)
@@ -17,15 +20,50 @@ type Server struct {
 	// func(args []interface{})
 	// func(args []interface{}) interface{}
 	// func(args []interface{}) []interface{}
-	functions map[interface{}]interface{}
-	ChanCall  chan *CallInfo
+	functions    map[interface{}]interface{}
+	ChanCall     chan *CallInfo
+	invoker      Invoker
+	interceptors []Interceptor
+	stats        *stats
+	// used in diagnostics
+	Name string
+}
+
+// Interceptor wraps the execution of every call of a server, next executes
+// the function (or the next interceptor)
+//
+// the result is nil, interface{} or []interface{} as returned by the function
+// and must keep the type when replaced
+// a panic of the function goes through the interceptors unless one of them
+// recovers it
+type Interceptor func(id interface{}, args []interface{}, next func() (interface{}, error)) (interface{}, error)
+
+// Invoker forwards a call to a server living elsewhere
+//
+// n:
+// -1 (no result wanted, as in Go)
+// 0 (as in Call0)
+// 1 (as in Call1)
+// 2 (as in CallN)
+//
+// ctx is done when the caller gives up (never for Go and the calls without
+// a context), cb must be called exactly once unless n is -1
+// must goroutine safe
+type Invoker func(ctx context.Context, id interface{}, args []interface{}, n int, cb func(ret interface{}, err error))
+
+type remoteFunc struct {
+	id interface{}
+	n  int
 }
 
 type CallInfo struct {
+	id      interface{}
 	f       interface{}
 	args    []interface{}
 	chanRet chan *RetInfo
 	cb      interface{}
+	// nil if the caller never gives up
+	ctx context.Context
 }
 
 type RetInfo struct {
@@ -52,6 +90,26 @@ func NewServer(l int) *Server {
 	s := new(Server)
 	s.functions = make(map[interface{}]interface{})
 	s.ChanCall = make(chan *CallInfo, l)
+	s.stats = newStats()
+	addServer(s)
+	return s
+}
+
+// the server forwards every call to invoker and needs no goroutine to
+// execute its calls
+//
+// the interceptors and the stats of the server do not apply to the
+// forwarded calls, they are executed by the server invoker forwards to
+func NewRemoteServer(l int, invoker Invoker) *Server {
+	s := NewServer(l)
+	s.invoker = invoker
+
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+
 	return s
 }
 
@@ -80,6 +138,12 @@ func (s *Server) Register(id interface{}, f interface{}) {
 	s.functions[id] = f
 }
 
+// the first interceptor is the outermost one
+// you must call the function before calling Open and Go
+func (s *Server) Use(interceptors ...Interceptor) {
+	s.interceptors = append(s.interceptors, interceptors...)
+}
+
 func (s *Server) ret(ci *CallInfo, ri *RetInfo) (err error) {
 	if ci.chanRet == nil {
 		return
@@ -97,6 +161,12 @@ func (s *Server) ret(ci *CallInfo, ri *RetInfo) (err error) {
 }
 
 func (s *Server) exec(ci *CallInfo) (err error) {
+	if conf.DeadlockDetection {
+		enter(s, ci.id)
+		defer leave()
+	}
+
+	var start time.Time
 	defer func() {
 		if r := recover(); r != nil {
 			if conf.LenStackBuf > 0 {
@@ -107,24 +177,62 @@ func (s *Server) exec(ci *CallInfo) (err error) {
 				err = fmt.Errorf("%v", r)
 			}
 
+			if !start.IsZero() {
+				s.stats.record(ci.id, time.Since(start), nil, true)
+			}
 			s.ret(ci, &RetInfo{err: fmt.Errorf("%v", r)})
 		}
 	}()
 
+	// remote
+	if f, ok := ci.f.(*remoteFunc); ok {
+		ctx := ci.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		if f.n < 0 {
+			s.invoker(ctx, f.id, ci.args, f.n, nil)
+			return
+		}
+		s.invoker(ctx, f.id, ci.args, f.n, func(ret interface{}, err error) {
+			s.ret(ci, &RetInfo{ret: ret, err: err})
+		})
+		return
+	}
+
 	// execute
-	switch ci.f.(type) {
-	case func([]interface{}):
-		ci.f.(func([]interface{}))(ci.args)
-		return s.ret(ci, &RetInfo{})
-	case func([]interface{}) interface{}:
-		ret := ci.f.(func([]interface{}) interface{})(ci.args)
-		return s.ret(ci, &RetInfo{ret: ret})
-	case func([]interface{}) []interface{}:
-		ret := ci.f.(func([]interface{}) []interface{})(ci.args)
-		return s.ret(ci, &RetInfo{ret: ret})
+	start = time.Now()
+	ret, callErr := s.call(ci)
+	s.stats.record(ci.id, time.Since(start), callErr, false)
+	if callErr != nil && ci.chanRet == nil {
+		return callErr
 	}
+	return s.ret(ci, &RetInfo{ret: ret, err: callErr})
+}
 
-	panic("bug")
+func (s *Server) call(ci *CallInfo) (interface{}, error) {
+	next := func() (interface{}, error) {
+		switch ci.f.(type) {
+		case func([]interface{}):
+			ci.f.(func([]interface{}))(ci.args)
+			return nil, nil
+		case func([]interface{}) interface{}:
+			return ci.f.(func([]interface{}) interface{})(ci.args), nil
+		case func([]interface{}) []interface{}:
+			return ci.f.(func([]interface{}) []interface{})(ci.args), nil
+		}
+
+		panic("bug")
+	}
+
+	for i := len(s.interceptors) - 1; i >= 0; i-- {
+		interceptor, _next := s.interceptors[i], next
+		next = func() (interface{}, error) {
+			return interceptor(ci.id, ci.args, _next)
+		}
+	}
+
+	return next()
 }
 
 func (s *Server) Exec(ci *CallInfo) {
@@ -136,7 +244,12 @@ func (s *Server) Exec(ci *CallInfo) {
 
 // goroutine safe
 func (s *Server) Go(id interface{}, args ...interface{}) {
-	f := s.functions[id]
+	var f interface{}
+	if s.invoker != nil {
+		f = &remoteFunc{id: id, n: -1}
+	} else {
+		f = s.functions[id]
+	}
 	if f == nil {
 		return
 	}
@@ -146,6 +259,7 @@ func (s *Server) Go(id interface{}, args ...interface{}) {
 	}()
 
 	s.ChanCall <- &CallInfo{
+		id:   id,
 		f:    f,
 		args: args,
 	}
@@ -166,7 +280,23 @@ func (s *Server) CallN(id interface{}, args ...interface{}) ([]interface{}, erro
 	return s.Open(0).CallN(id, args...)
 }
 
+// goroutine safe
+func (s *Server) Call0Context(ctx context.Context, id interface{}, args ...interface{}) error {
+	return s.Open(0).Call0Context(ctx, id, args...)
+}
+
+// goroutine safe
+func (s *Server) Call1Context(ctx context.Context, id interface{}, args ...interface{}) (interface{}, error) {
+	return s.Open(0).Call1Context(ctx, id, args...)
+}
+
+// goroutine safe
+func (s *Server) CallNContext(ctx context.Context, id interface{}, args ...interface{}) ([]interface{}, error) {
+	return s.Open(0).CallNContext(ctx, id, args...)
+}
+
 func (s *Server) Close() {
+	removeServer(s)
 	close(s.ChanCall)
 
 	for ci := range s.ChanCall {
@@ -195,20 +325,36 @@ func (c *Client) Attach(s *Server) {
 }
 
 func (c *Client) call(ci *CallInfo, block bool) (err error) {
+	if block {
+		return c.callContext(context.Background(), ci)
+	}
+
 	defer func() {
 		if r := recover(); r != nil {
 			err = r.(error)
 		}
 	}()
 
-	if block {
-		c.s.ChanCall <- ci
-	} else {
-		select {
-		case c.s.ChanCall <- ci:
-		default:
-			err = errors.New("chanrpc channel full")
+	select {
+	case c.s.ChanCall <- ci:
+	default:
+		atomic.AddInt64(&c.s.stats.rejections, 1)
+		err = errors.New("chanrpc channel full")
+	}
+	return
+}
+
+func (c *Client) callContext(ctx context.Context, ci *CallInfo) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
 		}
+	}()
+
+	select {
+	case c.s.ChanCall <- ci:
+	case <-ctx.Done():
+		err = ctx.Err()
 	}
 	return
 }
@@ -219,6 +365,11 @@ func (c *Client) f(id interface{}, n int) (f interface{}, err error) {
 		return
 	}
 
+	if c.s.invoker != nil {
+		f = &remoteFunc{id: id, n: n}
+		return
+	}
+
 	f = c.s.functions[id]
 	if f == nil {
 		err = fmt.Errorf("function id %v: function not registered", id)
@@ -243,83 +394,141 @@ func (c *Client) f(id interface{}, n int) (f interface{}, err error) {
 	return
 }
 
-func (c *Client) Call0(id interface{}, args ...interface{}) error {
-	f, err := c.f(id, 0)
+func (c *Client) syncCall(ctx context.Context, id interface{}, args []interface{}, n int) (*RetInfo, error) {
+	f, err := c.f(id, n)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = c.call(&CallInfo{
+	if conf.DeadlockDetection {
+		err = wait(c.s, id)
+		if err != nil {
+			return nil, err
+		}
+		defer done()
+	}
+
+	err = c.callContext(ctx, &CallInfo{
+		id:      id,
 		f:       f,
 		args:    args,
 		chanRet: c.chanSyncRet,
-	}, true)
+		ctx:     ctx,
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	ri := <-c.chanSyncRet
-	return ri.err
+	select {
+	case ri := <-c.chanSyncRet:
+		return ri, ri.err
+	case <-ctx.Done():
+		// the late result goes to the abandoned channel
+		c.chanSyncRet = make(chan *RetInfo, 1)
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) Call0(id interface{}, args ...interface{}) error {
+	return c.Call0Context(context.Background(), id, args...)
 }
 
 func (c *Client) Call1(id interface{}, args ...interface{}) (interface{}, error) {
-	f, err := c.f(id, 1)
-	if err != nil {
-		return nil, err
-	}
+	return c.Call1Context(context.Background(), id, args...)
+}
 
-	err = c.call(&CallInfo{
-		f:       f,
-		args:    args,
-		chanRet: c.chanSyncRet,
-	}, true)
-	if err != nil {
-		return nil, err
-	}
+func (c *Client) CallN(id interface{}, args ...interface{}) ([]interface{}, error) {
+	return c.CallNContext(context.Background(), id, args...)
+}
 
-	ri := <-c.chanSyncRet
-	return ri.ret, ri.err
+// the call gives up when ctx is done, a call already in the channel is
+// still executed by the server
+func (c *Client) Call0Context(ctx context.Context, id interface{}, args ...interface{}) error {
+	_, err := c.syncCall(ctx, id, args, 0)
+	return err
 }
 
-func (c *Client) CallN(id interface{}, args ...interface{}) ([]interface{}, error) {
-	f, err := c.f(id, 2)
-	if err != nil {
+func (c *Client) Call1Context(ctx context.Context, id interface{}, args ...interface{}) (interface{}, error) {
+	ri, err := c.syncCall(ctx, id, args, 1)
+	if ri == nil {
 		return nil, err
 	}
+	return ri.ret, err
+}
 
-	err = c.call(&CallInfo{
-		f:       f,
-		args:    args,
-		chanRet: c.chanSyncRet,
-	}, true)
-	if err != nil {
+func (c *Client) CallNContext(ctx context.Context, id interface{}, args ...interface{}) ([]interface{}, error) {
+	ri, err := c.syncCall(ctx, id, args, 2)
+	if ri == nil {
 		return nil, err
 	}
-
-	ri := <-c.chanSyncRet
-	return assert(ri.ret), ri.err
+	return assert(ri.ret), err
 }
 
-func (c *Client) asynCall(id interface{}, args []interface{}, cb interface{}, n int) {
+func (c *Client) asynCall(ctx context.Context, cancel context.CancelFunc, id interface{}, args []interface{}, cb interface{}, n int) {
 	f, err := c.f(id, n)
 	if err != nil {
+		if cancel != nil {
+			cancel()
+		}
 		c.ChanAsynRet <- &RetInfo{err: err, cb: cb}
 		return
 	}
 
-	err = c.call(&CallInfo{
+	ci := &CallInfo{
+		id:      id,
 		f:       f,
 		args:    args,
 		chanRet: c.ChanAsynRet,
 		cb:      cb,
-	}, false)
+	}
+	if ctx.Done() != nil {
+		ci.chanRet = make(chan *RetInfo, 1)
+		ci.ctx = ctx
+	}
+	chanRet := ci.chanRet
+
+	err = c.call(ci, false)
 	if err != nil {
+		if cancel != nil {
+			cancel()
+		}
 		c.ChanAsynRet <- &RetInfo{err: err, cb: cb}
 		return
 	}
+
+	if ctx.Done() != nil {
+		go func() {
+			if cancel != nil {
+				defer cancel()
+			}
+
+			select {
+			case ri := <-chanRet:
+				c.ChanAsynRet <- ri
+			case <-ctx.Done():
+				c.ChanAsynRet <- &RetInfo{err: ctx.Err(), cb: cb}
+			}
+		}()
+	}
 }
 
 func (c *Client) AsynCall(id interface{}, _args ...interface{}) {
+	c.asynCallContext(context.Background(), nil, id, _args)
+}
+
+// the callback is called with ctx.Err() when ctx is done before the result
+// arrives
+func (c *Client) AsynCallContext(ctx context.Context, id interface{}, _args ...interface{}) {
+	c.asynCallContext(ctx, nil, id, _args)
+}
+
+// the callback is called with context.DeadlineExceeded on timeout
+func (c *Client) AsynCallTimeout(d time.Duration, id interface{}, _args ...interface{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	c.asynCallContext(ctx, cancel, id, _args)
+}
+
+func (c *Client) asynCallContext(ctx context.Context, cancel context.CancelFunc, id interface{}, _args []interface{}) {
 	if len(_args) < 1 {
 		panic("callback function not found")
 	}
@@ -341,11 +550,14 @@ func (c *Client) AsynCall(id interface{}, _args ...interface{}) {
 
 	// too many calls
 	if c.pendingAsynCall >= cap(c.ChanAsynRet) {
+		if cancel != nil {
+			cancel()
+		}
 		execCb(&RetInfo{err: errors.New("too many calls"), cb: cb})
 		return
 	}
 
-	c.asynCall(id, args, cb, n)
+	c.asynCall(ctx, cancel, id, args, cb, n)
 	c.pendingAsynCall++
 }
 
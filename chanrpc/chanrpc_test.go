@@ -0,0 +1,118 @@
+package chanrpc_test
+
+import (
+	"context"
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/conf"
+	"testing"
+	"time"
+)
+
+func run(s *chanrpc.Server) {
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+}
+
+func TestCallContextTimeout(t *testing.T) {
+	// the call is not executed
+	s := chanrpc.NewServer(1)
+	s.Register("f", func(args []interface{}) interface{} {
+		return 1
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := s.Call1Context(ctx, "f")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("waiting for the result: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// the channel is full
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = s.Call1Context(ctx, "f")
+	if err == nil || err.Error() != "context deadline exceeded" {
+		t.Fatalf("sending the call: got %v, want context deadline exceeded", err)
+	}
+}
+
+func TestAsynCallTimeout(t *testing.T) {
+	s := chanrpc.NewServer(1)
+	s.Register("f", func(args []interface{}) {})
+
+	c := s.Open(1)
+	var err error
+	c.AsynCallTimeout(10*time.Millisecond, "f", func(e error) {
+		err = e
+	})
+	c.Cb(<-c.ChanAsynRet)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// in time
+	s = chanrpc.NewServer(1)
+	s.Register("f", func(args []interface{}) {})
+	run(s)
+	defer s.Close()
+
+	c = s.Open(1)
+	err = context.Canceled
+	c.AsynCallTimeout(time.Second, "f", func(e error) {
+		err = e
+	})
+	c.Cb(<-c.ChanAsynRet)
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+}
+
+func TestDeadlock(t *testing.T) {
+	conf.DeadlockDetection = true
+	defer func() {
+		conf.DeadlockDetection = false
+	}()
+
+	a := chanrpc.NewServer(10)
+	a.Name = "a"
+	b := chanrpc.NewServer(10)
+	b.Name = "b"
+
+	var errF, errG error
+	a.Register("f", func(args []interface{}) {
+		errF = b.Call0("g")
+	})
+	a.Register("h", func(args []interface{}) {})
+	b.Register("g", func(args []interface{}) {
+		errG = a.Call0("h")
+	})
+	a.Register("j", func(args []interface{}) {
+		errF = b.Call0("i")
+	})
+	b.Register("i", func(args []interface{}) {})
+	run(a)
+	defer a.Close()
+	run(b)
+	defer b.Close()
+
+	err := a.Call0("f")
+	if err != nil {
+		t.Fatalf("f: %v", err)
+	}
+	if errF != nil {
+		t.Fatalf("f calls g: %v", errF)
+	}
+	want := "chanrpc deadlock: b (executing g) calls h on a, a calls g on b"
+	if errG == nil || errG.Error() != want {
+		t.Fatalf("g calls h: got %v, want %v", errG, want)
+	}
+
+	// no cycle
+	err = a.Call0("j")
+	if err != nil || errF != nil {
+		t.Fatalf("j: %v, j calls i: %v", err, errF)
+	}
+}
@@ -0,0 +1,47 @@
+package chanrpc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// the timer of AsynCallTimeout is stopped when the call fails at once
+func TestAsynCallCancel(t *testing.T) {
+	tests := []struct {
+		name string
+		id   interface{}
+		// the pending calls of the client
+		pending int
+		err     string
+	}{
+		{"channel full", "f", 0, "chanrpc channel full"},
+		{"not registered", "g", 0, "function id g: function not registered"},
+		{"too many calls", "f", 1, "too many calls"},
+	}
+
+	for _, test := range tests {
+		s := NewServer(1)
+		s.Register("f", func(args []interface{}) {})
+		// fill the channel
+		s.Go("f")
+
+		c := s.Open(1)
+		c.pendingAsynCall = test.pending
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		var err error
+		c.asynCallContext(ctx, cancel, test.id, []interface{}{func(e error) {
+			err = e
+		}})
+		if test.pending == 0 {
+			c.Cb(<-c.ChanAsynRet)
+		}
+
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%v: got %v, want %v", test.name, err, test.err)
+		}
+		if ctx.Err() != context.Canceled {
+			t.Errorf("%v: got %v, want %v", test.name, ctx.Err(), context.Canceled)
+		}
+	}
+}
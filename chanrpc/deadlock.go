@@ -0,0 +1,101 @@
+package chanrpc
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/name5566/leaf/log"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// deadlock detection (conf.DeadlockDetection)
+//
+// a goroutine executing a call of a server stands for the server, a server
+// waits for another one while its goroutine makes a synchronous call, a
+// cycle in the wait graph is a deadlock
+
+type execInfo struct {
+	server *Server
+	id     interface{}
+}
+
+type waitInfo struct {
+	server *Server
+	id     interface{}
+}
+
+var (
+	mutexWait sync.Mutex
+	// goroutine id -> call being executed
+	executing = make(map[int64]*execInfo)
+	// server -> synchronous call its goroutine waits for
+	waiting = make(map[*Server]*waitInfo)
+)
+
+func goid() int64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	// goroutine 1 [running]: ...
+	fields := bytes.Fields(buf[:n])
+	if len(fields) < 2 {
+		return 0
+	}
+	id, _ := strconv.ParseInt(string(fields[1]), 10, 64)
+	return id
+}
+
+func (s *Server) String() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return fmt.Sprintf("%p", s)
+}
+
+func enter(s *Server, id interface{}) {
+	mutexWait.Lock()
+	executing[goid()] = &execInfo{server: s, id: id}
+	mutexWait.Unlock()
+}
+
+func leave() {
+	mutexWait.Lock()
+	delete(executing, goid())
+	mutexWait.Unlock()
+}
+
+// the calling goroutine is about to wait for a call of id on s
+func wait(s *Server, id interface{}) error {
+	mutexWait.Lock()
+	defer mutexWait.Unlock()
+
+	ei := executing[goid()]
+	if ei == nil {
+		return nil
+	}
+
+	// follow the wait graph from s
+	chain := fmt.Sprintf("%v (executing %v) calls %v on %v", ei.server, ei.id, id, s)
+	for t, n := s, 0; t != ei.server; n++ {
+		wi := waiting[t]
+		if wi == nil || n > len(waiting) {
+			waiting[ei.server] = &waitInfo{server: s, id: id}
+			return nil
+		}
+		chain += fmt.Sprintf(", %v calls %v on %v", t, wi.id, wi.server)
+		t = wi.server
+	}
+
+	err := fmt.Errorf("chanrpc deadlock: %v", chain)
+	log.Error("%v", err)
+	return err
+}
+
+func done() {
+	mutexWait.Lock()
+	defer mutexWait.Unlock()
+
+	if ei := executing[goid()]; ei != nil {
+		delete(waiting, ei.server)
+	}
+}
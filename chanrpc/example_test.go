@@ -1,6 +1,7 @@
 package chanrpc_test
 
 import (
+	"errors"
 	"fmt"
 	"github.com/name5566/leaf/chanrpc"
 	"sync"
@@ -125,3 +126,81 @@ func Example() {
 	// 1 2 3
 	// 3
 }
+
+func ExampleFunc() {
+	type AddReq struct {
+		N1, N2 int
+	}
+	add := chanrpc.NewFunc[AddReq, int]("add")
+
+	s := chanrpc.NewServer(10)
+	add.Register(s, func(req AddReq) int {
+		return req.N1 + req.N2
+	})
+
+	go func() {
+		for {
+			s.Exec(<-s.ChanCall)
+		}
+	}()
+
+	c := s.Open(10)
+
+	// sync
+	sum, err := add.Call(c, AddReq{1, 2})
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Println(sum)
+	}
+
+	// asyn
+	add.AsynCall(c, AddReq{3, 4}, func(sum int, err error) {
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println(sum)
+		}
+	})
+	c.Cb(<-c.ChanAsynRet)
+
+	// Output:
+	// 3
+	// 7
+}
+
+func ExampleServer_Use() {
+	s := chanrpc.NewServer(10)
+
+	// logging
+	s.Use(func(id interface{}, args []interface{}, next func() (interface{}, error)) (interface{}, error) {
+		ret, err := next()
+		fmt.Println(id, args, ret, err)
+		return ret, err
+	})
+
+	// auth
+	s.Use(func(id interface{}, args []interface{}, next func() (interface{}, error)) (interface{}, error) {
+		if args[0] != "admin" {
+			return nil, errors.New("permission denied")
+		}
+		return next()
+	})
+
+	s.Register("hello", func(args []interface{}) interface{} {
+		return "hello " + args[0].(string)
+	})
+
+	go func() {
+		for {
+			s.Exec(<-s.ChanCall)
+		}
+	}()
+
+	s.Call1("hello", "admin")
+	s.Call1("hello", "guest")
+
+	// Output:
+	// hello [admin] hello admin <nil>
+	// hello [guest] <nil> permission denied
+}
@@ -0,0 +1,151 @@
+package chanrpc
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the number of recent execution times kept per function for percentiles
+const lenSamples = 512
+
+type FuncStats struct {
+	ID      interface{}
+	Calls   int64
+	Errors  int64
+	Panics  int64
+	AvgTime time.Duration
+	P99Time time.Duration
+}
+
+type ServerStats struct {
+	Name     string
+	QueueLen int
+	QueueCap int
+	// calls rejected by "chanrpc channel full"
+	Rejections int64
+	Funcs      []FuncStats
+}
+
+type funcStats struct {
+	calls     int64
+	errors    int64
+	panics    int64
+	totalTime time.Duration
+	samples   [lenSamples]time.Duration
+	nSamples  int
+}
+
+type stats struct {
+	sync.Mutex
+	funcs      map[interface{}]*funcStats
+	rejections int64
+}
+
+var (
+	servers      = make(map[*Server]struct{})
+	mutexServers sync.Mutex
+)
+
+func newStats() *stats {
+	st := new(stats)
+	st.funcs = make(map[interface{}]*funcStats)
+	return st
+}
+
+func (st *stats) record(id interface{}, d time.Duration, err error, panicked bool) {
+	st.Lock()
+	defer st.Unlock()
+
+	fs := st.funcs[id]
+	if fs == nil {
+		fs = new(funcStats)
+		st.funcs[id] = fs
+	}
+
+	fs.calls++
+	if err != nil {
+		fs.errors++
+	}
+	if panicked {
+		fs.panics++
+	}
+	fs.totalTime += d
+	fs.samples[fs.nSamples%lenSamples] = d
+	fs.nSamples++
+}
+
+func (fs *funcStats) p99() time.Duration {
+	n := fs.nSamples
+	if n > lenSamples {
+		n = lenSamples
+	}
+	if n == 0 {
+		return 0
+	}
+
+	samples := make([]time.Duration, n)
+	copy(samples, fs.samples[:n])
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i] < samples[j]
+	})
+	return samples[(n*99-1)/100]
+}
+
+// goroutine safe
+func (s *Server) Stats() ServerStats {
+	ss := ServerStats{
+		Name:       s.String(),
+		QueueLen:   len(s.ChanCall),
+		QueueCap:   cap(s.ChanCall),
+		Rejections: atomic.LoadInt64(&s.stats.rejections),
+	}
+
+	s.stats.Lock()
+	for id, fs := range s.stats.funcs {
+		ss.Funcs = append(ss.Funcs, FuncStats{
+			ID:      id,
+			Calls:   fs.calls,
+			Errors:  fs.errors,
+			Panics:  fs.panics,
+			AvgTime: fs.totalTime / time.Duration(fs.calls),
+			P99Time: fs.p99(),
+		})
+	}
+	s.stats.Unlock()
+
+	sort.Slice(ss.Funcs, func(i, j int) bool {
+		return fmt.Sprint(ss.Funcs[i].ID) < fmt.Sprint(ss.Funcs[j].ID)
+	})
+	return ss
+}
+
+func addServer(s *Server) {
+	mutexServers.Lock()
+	servers[s] = struct{}{}
+	mutexServers.Unlock()
+}
+
+func removeServer(s *Server) {
+	mutexServers.Lock()
+	delete(servers, s)
+	mutexServers.Unlock()
+}
+
+// the servers not closed yet
+// goroutine safe
+func Servers() []*Server {
+	mutexServers.Lock()
+	ss := make([]*Server, 0, len(servers))
+	for s := range servers {
+		ss = append(ss, s)
+	}
+	mutexServers.Unlock()
+
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i].String() < ss[j].String()
+	})
+	return ss
+}
@@ -0,0 +1,74 @@
+package chanrpc
+
+import (
+	"context"
+	"fmt"
+)
+
+// Func binds a function id to its argument and return types so that the
+// handler and the callers are checked against each other at compile time
+// use struct{} as Resp if the function returns nothing
+type Func[Req, Resp any] struct {
+	ID interface{}
+}
+
+func NewFunc[Req, Resp any](id interface{}) Func[Req, Resp] {
+	return Func[Req, Resp]{ID: id}
+}
+
+func cast[T any](v interface{}) (T, bool) {
+	if v == nil {
+		var zero T
+		return zero, true
+	}
+
+	t, ok := v.(T)
+	return t, ok
+}
+
+// you must call the function before calling Open and Go
+func (f Func[Req, Resp]) Register(s *Server, h func(Req) Resp) {
+	s.Register(f.ID, func(args []interface{}) interface{} {
+		if len(args) != 1 {
+			panic(fmt.Sprintf("function id %v: 1 argument expected, got %v", f.ID, len(args)))
+		}
+		req, ok := cast[Req](args[0])
+		if !ok {
+			panic(fmt.Sprintf("function id %v: argument type mismatch: %T", f.ID, args[0]))
+		}
+
+		return h(req)
+	})
+}
+
+func (f Func[Req, Resp]) ret(ret interface{}, err error) (Resp, error) {
+	if err != nil {
+		var zero Resp
+		return zero, err
+	}
+
+	resp, ok := cast[Resp](ret)
+	if !ok {
+		return resp, fmt.Errorf("function id %v: return type mismatch: %T", f.ID, ret)
+	}
+	return resp, nil
+}
+
+func (f Func[Req, Resp]) Call(c *Client, req Req) (Resp, error) {
+	return f.ret(c.Call1(f.ID, req))
+}
+
+func (f Func[Req, Resp]) CallContext(ctx context.Context, c *Client, req Req) (Resp, error) {
+	return f.ret(c.Call1Context(ctx, f.ID, req))
+}
+
+func (f Func[Req, Resp]) AsynCall(c *Client, req Req, cb func(Resp, error)) {
+	c.AsynCall(f.ID, req, func(ret interface{}, err error) {
+		cb(f.ret(ret, err))
+	})
+}
+
+// goroutine safe
+func (f Func[Req, Resp]) Go(s *Server, req Req) {
+	s.Go(f.ID, req)
+}
@@ -0,0 +1,243 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/name5566/leaf/chanrpc"
+)
+
+// the types of ids, args and return values must be registered by gob.Register
+// (the basic types are registered by gob)
+type callInfo struct {
+	Seq    uint32
+	Server string
+	ID     interface{}
+	Args   []interface{}
+	N      int
+}
+
+type retInfo struct {
+	Seq uint32
+	Ret interface{}
+	Err string
+}
+
+type pendingCall struct {
+	node string
+	cb   func(ret interface{}, err error)
+	// closed when removed
+	done chan struct{}
+}
+
+func init() {
+	gob.Register([]interface{}(nil))
+	gob.Register(map[string]interface{}(nil))
+}
+
+// you must call the function before calling cluster.Init
+// goroutine not safe
+func Publish(name string, server *chanrpc.Server) {
+	std.Publish(name, server)
+}
+
+// you must call the function before calling Init
+// goroutine not safe
+func (c *Cluster) Publish(name string, server *chanrpc.Server) {
+	if _, ok := c.servers[name]; ok {
+		c.logger.Fatal("chanrpc server %v is already published", name)
+	}
+
+	c.servers[name] = server
+}
+
+// the returned server forwards calls to the server published as name on
+// the node, l is the length of its call channel as in chanrpc.NewServer
+//
+// a call is abandoned when its context is done (e.g. Call1Context or
+// AsynCallTimeout), a call without a context waits for the result until the
+// node disconnects
+// goroutine safe
+func NewRemoteServer(node string, name string, l int) *chanrpc.Server {
+	return std.NewRemoteServer(node, name, l)
+}
+
+// goroutine safe
+func (c *Cluster) NewRemoteServer(node string, name string, l int) *chanrpc.Server {
+	return chanrpc.NewRemoteServer(l, func(ctx context.Context, id interface{}, args []interface{}, n int, cb func(interface{}, error)) {
+		ci := &callInfo{
+			Server: name,
+			ID:     id,
+			Args:   args,
+			N:      n,
+		}
+		if n < 0 {
+			c.call(node, ci)
+			return
+		}
+
+		var pc *pendingCall
+		ci.Seq, pc = c.addPendingCall(node, cb)
+		err := c.call(node, ci)
+		if err != nil {
+			if pc := c.removePendingCall(ci.Seq); pc != nil {
+				pc.cb(nil, err)
+			}
+			return
+		}
+
+		if ctx.Done() != nil {
+			go func() {
+				select {
+				case <-pc.done:
+				case <-ctx.Done():
+					if pc := c.removePendingCall(ci.Seq); pc != nil {
+						pc.cb(nil, ctx.Err())
+					}
+				}
+			}()
+		}
+	})
+}
+
+func (c *Cluster) call(node string, ci *callInfo) error {
+	a := c.GetAgent(node)
+	if a == nil {
+		return fmt.Errorf("node %v not connected", node)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(msgCall)
+	err := gob.NewEncoder(&buf).Encode(ci)
+	if err != nil {
+		return err
+	}
+
+	return a.conn.WriteMsg(buf.Bytes())
+}
+
+func (c *Cluster) addPendingCall(node string, cb func(interface{}, error)) (uint32, *pendingCall) {
+	c.mutexPendingCalls.Lock()
+	defer c.mutexPendingCalls.Unlock()
+
+	c.seq++
+	pc := &pendingCall{node: node, cb: cb, done: make(chan struct{})}
+	c.pendingCalls[c.seq] = pc
+	return c.seq, pc
+}
+
+// returns nil if the call is already removed
+func (c *Cluster) removePendingCall(seq uint32) *pendingCall {
+	c.mutexPendingCalls.Lock()
+	defer c.mutexPendingCalls.Unlock()
+
+	pc := c.pendingCalls[seq]
+	if pc == nil {
+		return nil
+	}
+	delete(c.pendingCalls, seq)
+	close(pc.done)
+	return pc
+}
+
+func (c *Cluster) closePendingCalls(node string) {
+	var pcs []*pendingCall
+
+	c.mutexPendingCalls.Lock()
+	for seq, pc := range c.pendingCalls {
+		if pc.node == node {
+			pcs = append(pcs, pc)
+			delete(c.pendingCalls, seq)
+			close(pc.done)
+		}
+	}
+	c.mutexPendingCalls.Unlock()
+
+	for _, pc := range pcs {
+		pc.cb(nil, fmt.Errorf("node %v disconnected", node))
+	}
+}
+
+func (a *Agent) handleCall(payload []byte) {
+	ci := new(callInfo)
+	err := gob.NewDecoder(bytes.NewReader(payload)).Decode(ci)
+	if err != nil {
+		a.cluster.logger.Error("node %v: decode call error: %v", a.name, err)
+		return
+	}
+
+	s, ok := a.cluster.servers[ci.Server]
+	if !ok {
+		a.ret(ci, nil, fmt.Errorf("chanrpc server %v not published", ci.Server))
+		return
+	}
+
+	if ci.N < 0 {
+		s.Go(ci.ID, ci.Args...)
+		return
+	}
+
+	go func() {
+		var ret interface{}
+		var err error
+		switch ci.N {
+		case 0:
+			err = s.Call0(ci.ID, ci.Args...)
+		case 1:
+			ret, err = s.Call1(ci.ID, ci.Args...)
+		case 2:
+			ret, err = s.CallN(ci.ID, ci.Args...)
+		default:
+			err = errors.New("invalid call")
+		}
+		a.ret(ci, ret, err)
+	}()
+}
+
+func (a *Agent) ret(ci *callInfo, ret interface{}, err error) {
+	if ci.N < 0 {
+		return
+	}
+
+	ri := &retInfo{Seq: ci.Seq, Ret: ret}
+	if err != nil {
+		ri.Err = err.Error()
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(msgRet)
+	err = gob.NewEncoder(&buf).Encode(ri)
+	if err != nil {
+		ri.Ret = nil
+		ri.Err = err.Error()
+		buf.Reset()
+		buf.WriteByte(msgRet)
+		gob.NewEncoder(&buf).Encode(ri)
+	}
+
+	err = a.conn.WriteMsg(buf.Bytes())
+	if err != nil {
+		a.cluster.logger.Error("node %v: write ret error: %v", a.name, err)
+	}
+}
+
+func (a *Agent) handleRet(payload []byte) {
+	ri := new(retInfo)
+	err := gob.NewDecoder(bytes.NewReader(payload)).Decode(ri)
+	if err != nil {
+		a.cluster.logger.Error("node %v: decode ret error: %v", a.name, err)
+		return
+	}
+
+	pc := a.cluster.removePendingCall(ri.Seq)
+	if pc == nil {
+		return
+	}
+	if ri.Err != "" {
+		pc.cb(ri.Ret, errors.New(ri.Err))
+	} else {
+		pc.cb(ri.Ret, nil)
+	}
+}
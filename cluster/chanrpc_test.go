@@ -0,0 +1,122 @@
+package cluster
+
+import (
+	"context"
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/conf"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a call of wait returns after release is closed and then sends to done
+func newGameServer(t *testing.T, release chan bool, done chan bool) *chanrpc.Server {
+	s := chanrpc.NewServer(10)
+	s.Register("add", func(args []interface{}) interface{} {
+		return args[0].(int) + args[1].(int)
+	})
+	s.Register("swap", func(args []interface{}) []interface{} {
+		return []interface{}{args[1], args[0]}
+	})
+	s.Register("panic", func(args []interface{}) interface{} {
+		panic("game over")
+	})
+	s.Register("wait", func(args []interface{}) interface{} {
+		<-release
+		done <- true
+		return nil
+	})
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func pendingCalls(c *Cluster) int {
+	c.mutexPendingCalls.Lock()
+	defer c.mutexPendingCalls.Unlock()
+	return len(c.pendingCalls)
+}
+
+func TestRemoteCall(t *testing.T) {
+	release, done := make(chan bool), make(chan bool, 2)
+	a := newNodeWith(t, &conf.Config{NodeName: "a"}, map[string]*chanrpc.Server{"game": newGameServer(t, release, done)})
+	b := newNode(t, &conf.Config{NodeName: "b", ConnAddrs: []string{a.addr}})
+	a.expect(t, "NodeUp b")
+	b.expect(t, "NodeUp a")
+	game := b.NewRemoteServer("a", "game", 10)
+	t.Cleanup(game.Close)
+
+	ret, err := game.Call1("add", 1, 2)
+	if err != nil || ret != 3 {
+		t.Fatalf("add: %v %v", ret, err)
+	}
+	rets, err := game.CallN("swap", "x", "y")
+	if err != nil || len(rets) != 2 || rets[0] != "y" || rets[1] != "x" {
+		t.Fatalf("swap: %v %v", rets, err)
+	}
+
+	client := game.Open(10)
+	client.AsynCall("add", 3, 4, func(ret interface{}, err error) {
+		if err != nil || ret != 7 {
+			t.Errorf("asyn add: %v %v", ret, err)
+		}
+	})
+	select {
+	case ri := <-client.ChanAsynRet:
+		client.Cb(ri)
+	case <-time.After(2 * time.Second):
+		t.Fatal("asyn add: timeout")
+	}
+
+	// the errors of the remote node
+	_, err = game.Call1("panic")
+	if err == nil || !strings.Contains(err.Error(), "game over") {
+		t.Fatalf("panic: %v", err)
+	}
+	_, err = game.Call1("unknown")
+	if err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Fatalf("unknown id: %v", err)
+	}
+	_, err = b.NewRemoteServer("a", "chat", 1).Call1("add", 1, 2)
+	if err == nil || !strings.Contains(err.Error(), "not published") {
+		t.Fatalf("unknown server: %v", err)
+	}
+	_, err = b.NewRemoteServer("c", "game", 1).Call1("add", 1, 2)
+	if err == nil || !strings.Contains(err.Error(), "not connected") {
+		t.Fatalf("unknown node: %v", err)
+	}
+	if n := pendingCalls(b.Cluster); n != 0 {
+		t.Fatalf("%v pending calls", n)
+	}
+
+	// the abandoned calls are removed
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = game.Call1Context(ctx, "wait")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("wait: %v", err)
+	}
+	client.AsynCallTimeout(20*time.Millisecond, "wait", func(ret interface{}, err error) {
+		if err != context.DeadlineExceeded {
+			t.Errorf("asyn wait: %v", err)
+		}
+	})
+	select {
+	case ri := <-client.ChanAsynRet:
+		client.Cb(ri)
+	case <-time.After(2 * time.Second):
+		t.Fatal("asyn wait: timeout")
+	}
+	eventually(t, "the pending calls removed", func() bool {
+		return pendingCalls(b.Cluster) == 0
+	})
+
+	// the calls are still executed by a
+	close(release)
+	<-done
+	<-done
+}
@@ -1,65 +1,602 @@
 package cluster
 
 import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/name5566/leaf/chanrpc"
 	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/log"
 	"github.com/name5566/leaf/network"
 	"math"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var (
-	server  *network.TCPServer
-	clients []*network.TCPClient
-)
+type MsgHandler func(a *Agent, data []byte)
+
+// a Cluster is the cluster state of one node
+type Cluster struct {
+	conf   *conf.Config
+	logger *log.Logger
+
+	server       *network.TCPServer
+	clients      []*network.TCPClient
+	mutexClients sync.Mutex
+	closeFlag    bool
+
+	// node name -> agent
+	agents map[string]*Agent
+	// node name -> the other link to the node, see readHandshake
+	standby map[string]*Agent
+	// node name -> addrs of the seed nodes not dialed while the node is
+	// connected
+	pausedSeeds map[string][]string
+	mutexAgents sync.RWMutex
+
+	// addr -> handler
+	handlers      map[string]MsgHandler
+	mutexHandlers sync.RWMutex
+
+	// receive NodeUp and NodeDown
+	subscribers      []*chanrpc.Server
+	mutexSubscribers sync.RWMutex
+
+	self      NodeInfo
+	mutexSelf sync.RWMutex
+
+	// node name -> client
+	discovered      map[string]*network.TCPClient
+	mutexDiscovered sync.Mutex
+
+	// name -> server
+	servers map[string]*chanrpc.Server
+
+	// seq -> call
+	pendingCalls      map[uint32]*pendingCall
+	seq               uint32
+	mutexPendingCalls sync.Mutex
+}
+
+// the package level functions use the cluster of leaf.Run
+var std = New(nil)
+
+// the cluster of leaf.Run
+func Default() *Cluster {
+	return std
+}
+
+// the settings of the package conf are used if c is nil
+func New(c *conf.Config) *Cluster {
+	cl := new(Cluster)
+	cl.conf = c
+	cl.agents = make(map[string]*Agent)
+	cl.standby = make(map[string]*Agent)
+	cl.pausedSeeds = make(map[string][]string)
+	cl.handlers = make(map[string]MsgHandler)
+	cl.discovered = make(map[string]*network.TCPClient)
+	cl.servers = make(map[string]*chanrpc.Server)
+	cl.pendingCalls = make(map[uint32]*pendingCall)
+	return cl
+}
 
 func Init() {
-	if conf.ListenAddr != "" {
-		server = new(network.TCPServer)
-		server.Addr = conf.ListenAddr
-		server.MaxConnNum = int(math.MaxInt32)
-		server.PendingWriteNum = conf.PendingWriteNum
-		server.LenMsgLen = 4
-		server.MaxMsgLen = math.MaxUint32
-		server.NewAgent = newAgent
+	err := std.Init()
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+}
 
-		server.Start()
+func Destroy() {
+	std.Destroy()
+}
+
+// the logger of the package log is used if not called
+// you must call the function before calling Init
+func (c *Cluster) SetLogger(logger *log.Logger) {
+	c.logger = logger
+}
+
+// nil if SetLogger is not called
+func (c *Cluster) Logger() *log.Logger {
+	return c.logger
+}
+
+func (c *Cluster) Init() error {
+	if c.conf == nil {
+		c.conf = conf.Global()
+	}
+	if c.conf.ListenAddr == "" && len(c.conf.ConnAddrs) == 0 {
+		return nil
+	}
+	if c.conf.NodeName == "" {
+		return errors.New("NodeName must not be empty")
 	}
 
-	for _, addr := range conf.ConnAddrs {
-		client := new(network.TCPClient)
-		client.Addr = addr
-		client.ConnNum = 1
-		client.ConnectInterval = 3 * time.Second
-		client.PendingWriteNum = conf.PendingWriteNum
-		client.LenMsgLen = 4
-		client.MaxMsgLen = math.MaxUint32
-		client.NewAgent = newAgent
+	c.initSelf()
 
-		client.Start()
-		clients = append(clients, client)
+	if c.conf.ListenAddr != "" {
+		c.server = new(network.TCPServer)
+		c.server.Addr = c.conf.ListenAddr
+		c.server.MaxConnNum = int(math.MaxInt32)
+		c.server.PendingWriteNum = c.conf.PendingWriteNum
+		c.server.LenMsgLen = 4
+		c.server.MaxMsgLen = math.MaxUint32
+		c.server.NewAgent = c.newAgent
+		c.server.Logger = c.logger
+
+		err := c.server.Listen()
+		if err != nil {
+			c.server = nil
+			return err
+		}
+	}
+
+	// seed nodes
+	for _, addr := range c.conf.ConnAddrs {
+		c.dial(addr, "")
 	}
+
+	return nil
 }
 
-func Destroy() {
-	if server != nil {
-		server.Close()
+func (c *Cluster) Destroy() {
+	if c.server != nil {
+		c.server.Close()
 	}
 
+	c.mutexClients.Lock()
+	c.closeFlag = true
+	clients := c.clients
+	c.clients = nil
+	c.mutexClients.Unlock()
+
 	for _, client := range clients {
 		client.Close()
 	}
 }
 
+// name is empty for seed nodes, returns nil if destroyed
+func (c *Cluster) dial(addr string, name string) *network.TCPClient {
+	c.mutexClients.Lock()
+	defer c.mutexClients.Unlock()
+	if c.closeFlag {
+		return nil
+	}
+
+	client := new(network.TCPClient)
+	client.Addr = addr
+	client.ConnNum = 1
+	client.ConnectInterval = c.connectInterval()
+	client.PendingWriteNum = c.conf.PendingWriteNum
+	client.Logger = c.logger
+	client.LenMsgLen = 4
+	client.MaxMsgLen = math.MaxUint32
+	if name != "" {
+		client.ConnectRetries = discoverRetries
+		client.OnGiveUp = func() {
+			c.removeClient(client)
+			c.forget(name)
+		}
+	}
+	client.NewAgent = func(conn *network.TCPConn) network.Agent {
+		a := c.newAgent(conn).(*Agent)
+		a.dialed = true
+		a.client = client
+		if name == "" {
+			a.seed = addr
+		} else {
+			a.discovered = name
+		}
+		return a
+	}
+
+	client.Start()
+	c.clients = append(c.clients, client)
+	return client
+}
+
+func (c *Cluster) connectInterval() time.Duration {
+	if c.conf.ConnectInterval <= 0 {
+		return 3 * time.Second
+	}
+	return c.conf.ConnectInterval
+}
+
+// a seed node is dialed again after ConnectInterval
+func (c *Cluster) redial(addr string) {
+	time.AfterFunc(c.connectInterval(), func() {
+		c.dial(addr, "")
+	})
+}
+
+// a client is not reconnected and is removed when its agent is closed
+func (c *Cluster) removeClient(client *network.TCPClient) {
+	c.mutexClients.Lock()
+	defer c.mutexClients.Unlock()
+	for i, cl := range c.clients {
+		if cl == client {
+			c.clients = append(c.clients[:i], c.clients[i+1:]...)
+			return
+		}
+	}
+}
+
+// goroutine safe
+func SetHandler(addr string, h MsgHandler) {
+	std.SetHandler(addr, h)
+}
+
+// goroutine safe
+func (c *Cluster) SetHandler(addr string, h MsgHandler) {
+	c.mutexHandlers.Lock()
+	defer c.mutexHandlers.Unlock()
+	if _, ok := c.handlers[addr]; ok {
+		c.logger.Fatal("message address %v is already registered", addr)
+	}
+
+	c.handlers[addr] = h
+}
+
+func (c *Cluster) handler(addr string) MsgHandler {
+	c.mutexHandlers.RLock()
+	defer c.mutexHandlers.RUnlock()
+	return c.handlers[addr]
+}
+
+// goroutine safe
+func SetRouter(addr string, server *chanrpc.Server) {
+	std.SetRouter(addr, server)
+}
+
+// goroutine safe
+func (c *Cluster) SetRouter(addr string, server *chanrpc.Server) {
+	c.SetHandler(addr, func(a *Agent, data []byte) {
+		server.Go(addr, data, a)
+	})
+}
+
+// the server receives NodeUp and NodeDown with a NodeInfo argument
+// the nodes connected before the call are not notified
+// goroutine safe
+func Subscribe(server *chanrpc.Server) {
+	std.Subscribe(server)
+}
+
+// goroutine safe
+func (c *Cluster) Subscribe(server *chanrpc.Server) {
+	c.mutexSubscribers.Lock()
+	defer c.mutexSubscribers.Unlock()
+	c.subscribers = append(c.subscribers, server)
+}
+
+func (c *Cluster) notify(id string, info NodeInfo) {
+	c.mutexSubscribers.RLock()
+	subscribers := c.subscribers
+	c.mutexSubscribers.RUnlock()
+
+	for _, s := range subscribers {
+		s.Go(id, info)
+	}
+}
+
+// goroutine safe
+func GetAgent(name string) *Agent {
+	return std.GetAgent(name)
+}
+
+// goroutine safe
+func (c *Cluster) GetAgent(name string) *Agent {
+	c.mutexAgents.RLock()
+	defer c.mutexAgents.RUnlock()
+	return c.agents[name]
+}
+
+// goroutine safe
+func Send(name string, addr string, data []byte) error {
+	return std.Send(name, addr, data)
+}
+
+// goroutine safe
+func (c *Cluster) Send(name string, addr string, data []byte) error {
+	a := c.GetAgent(name)
+	if a == nil {
+		return fmt.Errorf("node %v not connected", name)
+	}
+
+	return a.WriteMsg(addr, data)
+}
+
 type Agent struct {
-	conn *network.TCPConn
+	cluster *Cluster
+	conn    *network.TCPConn
+	info    NodeInfo
+	// empty until the handshake succeeds
+	name string
+	// the name in the handshake
+	peer string
+	// the node is dialed by us
+	dialed bool
+	// the other node uses the other link, see readHandshake
+	switched   bool
+	seed       string
+	discovered string
+	client     *network.TCPClient
+	lastRecv   int64
+	closeChan  chan struct{}
 }
 
-func newAgent(conn *network.TCPConn) network.Agent {
+func (c *Cluster) newAgent(conn *network.TCPConn) network.Agent {
 	a := new(Agent)
+	a.cluster = c
 	a.conn = conn
+	a.lastRecv = time.Now().UnixNano()
+	a.closeChan = make(chan struct{})
 	return a
 }
 
-func (a *Agent) Run() {}
+func (a *Agent) writeHandshake() error {
+	var buf bytes.Buffer
+	buf.WriteByte(msgHandshake)
+	err := gob.NewEncoder(&buf).Encode(a.cluster.Self())
+	if err != nil {
+		return err
+	}
+
+	return a.conn.WriteMsg(buf.Bytes())
+}
+
+var errDuplicate = errors.New("already connected")
+
+// of two links between the same nodes (e.g. both are seeds of each other) the
+// one dialed by the lower-named node is kept and the other one is on standby:
+// the lower-named node sends switch on it once it has both and the
+// higher-named node closes it once it has both and the switch, so neither
+// node sees the node go down
+//
+// returns true if the node is already connected by another link
+func (a *Agent) readHandshake() (bool, error) {
+	msg, err := a.readMsg()
+	if err != nil {
+		return false, err
+	}
+	if msg[0] != msgHandshake {
+		return false, errors.New("invalid handshake message")
+	}
+	var info NodeInfo
+	err = gob.NewDecoder(bytes.NewReader(msg[1:])).Decode(&info)
+	if err != nil {
+		return false, err
+	}
+	c := a.cluster
+	if info.Name == "" || info.Name == c.conf.NodeName {
+		return false, fmt.Errorf("invalid node name %v", info.Name)
+	}
+
+	c.mutexAgents.Lock()
+	defer c.mutexAgents.Unlock()
+	a.peer = info.Name
+	old := c.agents[info.Name]
+	if old == nil {
+		c.agents[info.Name] = a
+		a.info = info
+		a.name = info.Name
+		return false, nil
+	}
+	// a node of the same name or a third link
+	if a.dialer() == old.dialer() || c.standby[info.Name] != nil {
+		return false, errDuplicate
+	}
+
+	a.info = info
+	a.name = info.Name
+	standby := a
+	if a.dialer() < old.dialer() {
+		c.agents[info.Name] = a
+		standby = old
+	}
+	c.standby[info.Name] = standby
+	if !standby.dialed {
+		standby.conn.WriteMsg([]byte{msgSwitch})
+	} else if standby.switched {
+		standby.conn.Close()
+	}
+
+	return true, nil
+}
+
+func (a *Agent) dialer() string {
+	if a.dialed {
+		return a.cluster.conf.NodeName
+	}
+	return a.peer
+}
+
+// the other node uses the other link
+func (a *Agent) handleSwitch() {
+	c := a.cluster
+	c.mutexAgents.Lock()
+	a.switched = true
+	standby := c.standby[a.name] == a
+	c.mutexAgents.Unlock()
+
+	if standby {
+		a.conn.Close()
+	}
+}
+
+func (a *Agent) readMsg() ([]byte, error) {
+	msg, err := a.conn.ReadMsg()
+	if err == nil {
+		atomic.StoreInt64(&a.lastRecv, time.Now().UnixNano())
+	}
+	return msg, err
+}
+
+// the connection is destroyed if nothing is received within HeartbeatTimeout
+func (a *Agent) heartbeat() {
+	interval := a.cluster.conf.HeartbeatInterval
+	timeout := a.cluster.conf.HeartbeatTimeout
+	if interval <= 0 {
+		return
+	}
 
-func (a *Agent) OnClose() {}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.closeChan:
+			return
+		case <-ticker.C:
+			lastRecv := time.Unix(0, atomic.LoadInt64(&a.lastRecv))
+			if timeout > 0 && time.Since(lastRecv) > timeout {
+				a.cluster.logger.Error("node %v (%v): heartbeat timeout", a.Info().Name, a.conn.RemoteAddr())
+				a.conn.Destroy()
+				return
+			}
+			a.conn.WriteMsg([]byte{msgPing})
+		}
+	}
+}
+
+func (a *Agent) Run() {
+	defer close(a.closeChan)
+
+	err := a.writeHandshake()
+	if err != nil {
+		a.cluster.logger.Error("handshake with %v error: %v", a.conn.RemoteAddr(), err)
+		return
+	}
+	go a.heartbeat()
+	replaced, err := a.readHandshake()
+	if err == errDuplicate {
+		a.cluster.logger.Debug("node %v (%v) is already connected", a.peer, a.conn.RemoteAddr())
+		return
+	}
+	if err != nil {
+		a.cluster.logger.Error("handshake with %v error: %v", a.conn.RemoteAddr(), err)
+		return
+	}
+	a.cluster.logger.Release("node %v connected (%v)", a.name, a.conn.RemoteAddr())
+	if !replaced {
+		a.cluster.onNodeUp(a)
+		a.cluster.notify("NodeUp", a.Info())
+	}
+
+	for {
+		msg, err := a.readMsg()
+		if err != nil {
+			a.cluster.logger.Debug("read message: %v", err)
+			break
+		}
+
+		switch msg[0] {
+		case msgData:
+			addr, data, err := unpackData(msg[1:])
+			if err != nil {
+				a.cluster.logger.Error("node %v: %v", a.name, err)
+				return
+			}
+			h := a.cluster.handler(addr)
+			if h == nil {
+				a.cluster.logger.Debug("node %v: message address %v not registered", a.name, addr)
+				continue
+			}
+			h(a, data)
+		case msgCall:
+			a.handleCall(msg[1:])
+		case msgRet:
+			a.handleRet(msg[1:])
+		case msgNodes:
+			a.handleNodes(msg[1:])
+		case msgPing:
+			a.conn.WriteMsg([]byte{msgPong})
+		case msgPong:
+		case msgSwitch:
+			a.handleSwitch()
+		case msgLeave:
+			a.handleLeave(msg[1:])
+		default:
+			a.cluster.logger.Error("node %v: invalid message type %v", a.name, msg[0])
+			return
+		}
+	}
+}
+
+func (a *Agent) OnClose() {
+	c := a.cluster
+	// removed last, Destroy waits for the clients it finds
+	if a.client != nil {
+		defer c.removeClient(a.client)
+	}
+	if a.discovered != "" {
+		c.forget(a.discovered)
+	}
+
+	var seeds []string
+	c.mutexAgents.Lock()
+	down := a.name != "" && c.agents[a.name] == a
+	if c.standby[a.name] == a {
+		delete(c.standby, a.name)
+	}
+	if standby := c.standby[a.name]; down && standby != nil {
+		c.agents[a.name] = standby
+		standby.switched = false
+		delete(c.standby, a.name)
+		down = false
+	}
+	if down {
+		delete(c.agents, a.name)
+		seeds = c.pausedSeeds[a.name]
+		delete(c.pausedSeeds, a.name)
+	}
+	if a.seed != "" {
+		// the seed node is connected by another link
+		if a.peer != "" && c.agents[a.peer] != nil {
+			c.pausedSeeds[a.peer] = append(c.pausedSeeds[a.peer], a.seed)
+		} else {
+			seeds = append(seeds, a.seed)
+		}
+	}
+	c.mutexAgents.Unlock()
+
+	for _, addr := range seeds {
+		c.redial(addr)
+	}
+	if !down {
+		return
+	}
+
+	c.closePendingCalls(a.name)
+	a.cluster.logger.Release("node %v disconnected", a.name)
+	c.notify("NodeDown", a.Info())
+	c.broadcastLeave(a.name)
+}
+
+// the name of the remote node
+func (a *Agent) Name() string {
+	return a.name
+}
+
+// goroutine safe
+func (a *Agent) Info() NodeInfo {
+	a.cluster.mutexAgents.RLock()
+	defer a.cluster.mutexAgents.RUnlock()
+	return a.info
+}
+
+// goroutine safe
+func (a *Agent) WriteMsg(addr string, data []byte) error {
+	msg, err := packData(addr, data)
+	if err != nil {
+		return err
+	}
+
+	return a.conn.WriteMsg(msg...)
+}
+
+func (a *Agent) Close() {
+	a.conn.Close()
+}
@@ -0,0 +1,359 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/conf"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// a cluster on a loopback address recording its NodeUp and NodeDown
+type node struct {
+	*Cluster
+	addr   string
+	events chan string
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// c.ListenAddr and c.ConnectInterval are set if zero
+func newNode(t *testing.T, c *conf.Config) *node {
+	return newNodeWith(t, c, nil)
+}
+
+// the same as newNode but publishes servers (name -> server)
+func newNodeWith(t *testing.T, c *conf.Config, servers map[string]*chanrpc.Server) *node {
+	if c.ListenAddr == "" {
+		c.ListenAddr = freeAddr(t)
+	}
+	if c.ConnectInterval == 0 {
+		c.ConnectInterval = 20 * time.Millisecond
+	}
+	c.PendingWriteNum = 100
+
+	n := &node{Cluster: New(c), addr: c.ListenAddr, events: make(chan string, 100)}
+	s := chanrpc.NewServer(100)
+	s.Register("NodeUp", func(args []interface{}) {
+		n.events <- "NodeUp " + args[0].(NodeInfo).Name
+	})
+	s.Register("NodeDown", func(args []interface{}) {
+		n.events <- "NodeDown " + args[0].(NodeInfo).Name
+	})
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+	n.Subscribe(s)
+	for name, server := range servers {
+		n.Publish(name, server)
+	}
+
+	err := n.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		n.Destroy()
+		s.Close()
+	})
+	return n
+}
+
+// the events are expected in any order
+func (n *node) expect(t *testing.T, events ...string) {
+	t.Helper()
+	want := make(map[string]int)
+	for _, e := range events {
+		want[e]++
+	}
+
+	timeout := time.After(2 * time.Second)
+	for len(want) > 0 {
+		select {
+		case e := <-n.events:
+			if want[e] == 0 {
+				t.Fatalf("node %v: unexpected %v", n.conf.NodeName, e)
+			}
+			want[e]--
+			if want[e] == 0 {
+				delete(want, e)
+			}
+		case <-timeout:
+			t.Fatalf("node %v: timeout waiting for %v", n.conf.NodeName, want)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	a := newNode(t, &conf.Config{NodeName: "a", NodeType: "gate"})
+	b := newNode(t, &conf.Config{NodeName: "b", NodeType: "game", ConnAddrs: []string{a.addr}})
+	a.expect(t, "NodeUp b")
+	b.expect(t, "NodeUp a")
+
+	info, ok := a.GetNode("b")
+	if !ok || info.Name != "b" || info.Type != "game" || info.Addr != b.addr {
+		t.Fatalf("node b: %+v %v", info, ok)
+	}
+	info, ok = b.GetNode("a")
+	if !ok || info.Type != "gate" || info.Addr != a.addr {
+		t.Fatalf("node a: %+v %v", info, ok)
+	}
+
+	// a name is connected once
+	newNode(t, &conf.Config{NodeName: "b", ConnAddrs: []string{a.addr}})
+	time.Sleep(100 * time.Millisecond)
+	if nodes := a.Nodes(""); len(nodes) != 1 || nodes[0].Type != "game" || nodes[0].Addr != b.addr {
+		t.Fatalf("nodes of a: %+v", nodes)
+	}
+	select {
+	case e := <-a.events:
+		t.Fatalf("node a: unexpected %v", e)
+	default:
+	}
+}
+
+func TestDataFraming(t *testing.T) {
+	tests := []struct {
+		addr string
+		data []byte
+	}{
+		{"a", nil},
+		{"game.chat", []byte("hello")},
+		{string(make([]byte, 300)), []byte{0, 1, 2}},
+	}
+	for _, test := range tests {
+		msg, err := packData(test.addr, test.data)
+		if err != nil {
+			t.Fatalf("%q: %v", test.addr, err)
+		}
+		b := bytes.Join(msg, nil)
+		if b[0] != msgData {
+			t.Fatalf("%q: type %v", test.addr, b[0])
+		}
+		addr, data, err := unpackData(b[1:])
+		if err != nil || addr != test.addr || !bytes.Equal(data, test.data) {
+			t.Fatalf("%q: got %q %q %v", test.addr, addr, data, err)
+		}
+	}
+
+	_, err := packData("", nil)
+	if err == nil {
+		t.Fatal("empty address packed")
+	}
+	for _, payload := range [][]byte{nil, {0}, {0, 0}, {0, 5, 'a'}} {
+		_, _, err = unpackData(payload)
+		if err == nil {
+			t.Fatalf("%v unpacked", payload)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	a := newNode(t, &conf.Config{NodeName: "a"})
+	b := newNode(t, &conf.Config{NodeName: "b", ConnAddrs: []string{a.addr}})
+	a.expect(t, "NodeUp b")
+	b.expect(t, "NodeUp a")
+
+	type msg struct {
+		from string
+		data string
+	}
+	received := make(chan msg, 10)
+	a.SetHandler("echo", func(ag *Agent, data []byte) {
+		received <- msg{ag.Name(), string(data)}
+		ag.WriteMsg("reply", append([]byte("re: "), data...))
+	})
+	b.SetHandler("reply", func(ag *Agent, data []byte) {
+		received <- msg{ag.Name(), string(data)}
+	})
+
+	for _, s := range []string{"hello", "", "world"} {
+		err := b.Send("a", "echo", []byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// in order
+	want := []msg{
+		{"b", "hello"}, {"a", "re: hello"},
+		{"b", ""}, {"a", "re: "},
+		{"b", "world"}, {"a", "re: world"},
+	}
+	var got []msg
+	for range want {
+		select {
+		case m := <-received:
+			got = append(got, m)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout, got %v", got)
+		}
+	}
+	// the replies and the next messages interleave
+	var fromB, fromA []msg
+	for _, m := range got {
+		if m.from == "b" {
+			fromB = append(fromB, m)
+		} else {
+			fromA = append(fromA, m)
+		}
+	}
+	for i := range fromB {
+		if fromB[i] != want[2*i] || fromA[i] != want[2*i+1] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+
+	err := b.Send("c", "echo", nil)
+	if err == nil {
+		t.Fatal("sent to an unknown node")
+	}
+}
+
+// a node which completes the handshake and then sends nothing
+func silentNode(t *testing.T, name string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+	})
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var buf bytes.Buffer
+		buf.Write([]byte{0, 0, 0, 0, msgHandshake})
+		gob.NewEncoder(&buf).Encode(NodeInfo{Name: name})
+		b := buf.Bytes()
+		binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+		conn.Write(b)
+
+		// read the pings until closed
+		io.Copy(ioutil.Discard, conn)
+	}()
+	return ln.Addr().String()
+}
+
+func TestHeartbeat(t *testing.T) {
+	interval, timeout := 20*time.Millisecond, 100*time.Millisecond
+
+	// alive
+	a := newNode(t, &conf.Config{NodeName: "a", HeartbeatInterval: interval, HeartbeatTimeout: timeout})
+	b := newNode(t, &conf.Config{NodeName: "b", ConnAddrs: []string{a.addr}, HeartbeatInterval: interval, HeartbeatTimeout: timeout})
+	a.expect(t, "NodeUp b")
+	b.expect(t, "NodeUp a")
+	time.Sleep(3 * timeout)
+	if a.GetAgent("b") == nil || b.GetAgent("a") == nil {
+		t.Fatal("a live link is closed")
+	}
+
+	// dead
+	addr := silentNode(t, "silent")
+	c := newNode(t, &conf.Config{NodeName: "c", ConnAddrs: []string{addr}, HeartbeatInterval: interval, HeartbeatTimeout: timeout})
+	c.expect(t, "NodeUp silent")
+	start := time.Now()
+	c.expect(t, "NodeDown silent")
+	if d := time.Since(start); d < timeout-interval {
+		t.Fatalf("closed after %v, want the heartbeat timeout", d)
+	}
+
+	select {
+	case e := <-a.events:
+		t.Fatalf("node a: unexpected %v", e)
+	case e := <-b.events:
+		t.Fatalf("node b: unexpected %v", e)
+	default:
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	a := newNode(t, &conf.Config{NodeName: "a"})
+	b := newNode(t, &conf.Config{NodeName: "b", ConnAddrs: []string{a.addr}})
+	a.expect(t, "NodeUp b")
+	b.expect(t, "NodeUp a")
+
+	// a seed node is dialed again
+	a.Destroy()
+	a.expect(t, "NodeDown b")
+	b.expect(t, "NodeDown a")
+	a2 := newNode(t, &conf.Config{NodeName: "a", ListenAddr: a.addr})
+
+	timeout := 2 * time.Second
+	select {
+	case e := <-a2.events:
+		if e != "NodeUp b" {
+			t.Fatalf("node a: unexpected %v", e)
+		}
+	case <-time.After(timeout):
+		t.Fatal("b did not reconnect")
+	}
+	select {
+	case e := <-b.events:
+		if e != "NodeUp a" {
+			t.Fatalf("node b: unexpected %v", e)
+		}
+	case <-time.After(timeout):
+		t.Fatal("b did not reconnect")
+	}
+}
+
+func TestMutualSeeds(t *testing.T) {
+	addrA, addrB := freeAddr(t), freeAddr(t)
+	b := newNode(t, &conf.Config{NodeName: "b", ListenAddr: addrB, ConnAddrs: []string{addrA}})
+	a := newNode(t, &conf.Config{NodeName: "a", ListenAddr: addrA, ConnAddrs: []string{addrB}})
+	a.expect(t, "NodeUp b")
+	b.expect(t, "NodeUp a")
+
+	// the link dialed by a is kept and b does not dial a again
+	eventually(t, "one link", func() bool {
+		b.mutexClients.Lock()
+		defer b.mutexClients.Unlock()
+		return len(b.clients) == 0
+	})
+	time.Sleep(10 * b.conf.ConnectInterval)
+	if ag := a.GetAgent("b"); ag == nil || !ag.dialed {
+		t.Fatal("a does not keep the link it dialed")
+	}
+	if ag := b.GetAgent("a"); ag == nil || ag.dialed {
+		t.Fatal("b does not keep the link dialed by a")
+	}
+	b.mutexClients.Lock()
+	clients := len(b.clients)
+	b.mutexClients.Unlock()
+	if clients != 0 {
+		t.Fatalf("b dials a again (%v clients)", clients)
+	}
+	select {
+	case e := <-a.events:
+		t.Fatalf("node a: unexpected %v", e)
+	case e := <-b.events:
+		t.Fatalf("node b: unexpected %v", e)
+	default:
+	}
+
+	// b dials a again when a is down
+	a.Destroy()
+	b.expect(t, "NodeDown a")
+	a2 := newNode(t, &conf.Config{NodeName: "a", ListenAddr: addrA})
+	a2.expect(t, "NodeUp b")
+	b.expect(t, "NodeUp a")
+}
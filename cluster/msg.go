@@ -0,0 +1,82 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// message types
+const (
+	msgHandshake = iota + 1
+	msgData
+	msgCall
+	msgRet
+	msgNodes
+	msgPing
+	msgPong
+	msgSwitch
+	msgLeave
+)
+
+// -----------------------
+// | type | payload      |
+// -----------------------
+//
+// handshake payload:
+// ------------------
+// | gob(NodeInfo)  |
+// ------------------
+//
+// data payload:
+// ------------------------------
+// | len(addr) | addr | data    |
+// ------------------------------
+// len(addr) is a 2-byte big-endian integer
+//
+// call payload:
+// -------------------
+// | gob(callInfo)   |
+// -------------------
+//
+// ret payload:
+// -------------------
+// | gob(retInfo)    |
+// -------------------
+//
+// nodes payload:
+// -------------------
+// | gob([]NodeInfo) |
+// -------------------
+//
+// leave payload:
+// ------------
+// | name     |
+// ------------
+//
+// ping, pong and switch have no payload
+
+func packData(addr string, data []byte) ([][]byte, error) {
+	if len(addr) == 0 || len(addr) > math.MaxUint16 {
+		return nil, errors.New("invalid message address")
+	}
+
+	header := make([]byte, 3+len(addr))
+	header[0] = msgData
+	binary.BigEndian.PutUint16(header[1:], uint16(len(addr)))
+	copy(header[3:], addr)
+
+	return [][]byte{header, data}, nil
+}
+
+func unpackData(payload []byte) (string, []byte, error) {
+	if len(payload) < 2 {
+		return "", nil, errors.New("invalid data message")
+	}
+	l := int(binary.BigEndian.Uint16(payload))
+	if l == 0 || len(payload) < 2+l {
+		return "", nil, errors.New("invalid data message")
+	}
+
+	return string(payload[2 : 2+l]), payload[2+l:], nil
+}
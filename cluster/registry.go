@@ -0,0 +1,219 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/name5566/leaf/network"
+	"sort"
+)
+
+type NodeInfo struct {
+	Name string
+	Type string
+	// the address other nodes connect to
+	Addr string
+	Load int
+}
+
+func (c *Cluster) initSelf() {
+	c.mutexSelf.Lock()
+	defer c.mutexSelf.Unlock()
+
+	c.self.Name = c.conf.NodeName
+	c.self.Type = c.conf.NodeType
+	c.self.Addr = c.conf.AdvertiseAddr
+	if c.self.Addr == "" {
+		c.self.Addr = c.conf.ListenAddr
+	}
+}
+
+// goroutine safe
+func Self() NodeInfo {
+	return std.Self()
+}
+
+// goroutine safe
+func (c *Cluster) Self() NodeInfo {
+	c.mutexSelf.RLock()
+	defer c.mutexSelf.RUnlock()
+	return c.self
+}
+
+// the load is announced to all connected nodes
+// goroutine safe
+func SetLoad(load int) {
+	std.SetLoad(load)
+}
+
+// goroutine safe
+func (c *Cluster) SetLoad(load int) {
+	c.mutexSelf.Lock()
+	c.self.Load = load
+	info := c.self
+	c.mutexSelf.Unlock()
+
+	c.broadcastNodes([]NodeInfo{info}, nil)
+}
+
+// goroutine safe
+func GetNode(name string) (NodeInfo, bool) {
+	return std.GetNode(name)
+}
+
+// goroutine safe
+func (c *Cluster) GetNode(name string) (NodeInfo, bool) {
+	a := c.GetAgent(name)
+	if a == nil {
+		return NodeInfo{}, false
+	}
+
+	return a.Info(), true
+}
+
+// the connected nodes of the type sorted by name, all connected nodes if typ
+// is empty
+// goroutine safe
+func Nodes(typ string) []NodeInfo {
+	return std.Nodes(typ)
+}
+
+// goroutine safe
+func (c *Cluster) Nodes(typ string) []NodeInfo {
+	c.mutexAgents.RLock()
+	var nodes []NodeInfo
+	for _, a := range c.agents {
+		if typ == "" || a.info.Type == typ {
+			nodes = append(nodes, a.info)
+		}
+	}
+	c.mutexAgents.RUnlock()
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+	return nodes
+}
+
+func packNodes(nodes []NodeInfo) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(msgNodes)
+	err := gob.NewEncoder(&buf).Encode(nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c *Cluster) broadcastNodes(nodes []NodeInfo, except *Agent) {
+	msg, err := packNodes(nodes)
+	if err != nil {
+		c.logger.Error("pack nodes error: %v", err)
+		return
+	}
+
+	c.mutexAgents.RLock()
+	defer c.mutexAgents.RUnlock()
+	for _, a := range c.agents {
+		if a != except {
+			a.conn.WriteMsg(msg)
+		}
+	}
+}
+
+// gossip: a new node learns all the nodes we know and the others learn the
+// new node
+func (c *Cluster) onNodeUp(a *Agent) {
+	nodes := append(c.Nodes(""), c.Self())
+	msg, err := packNodes(nodes)
+	if err != nil {
+		c.logger.Error("pack nodes error: %v", err)
+		return
+	}
+	a.conn.WriteMsg(msg)
+
+	c.broadcastNodes([]NodeInfo{a.Info()}, a)
+}
+
+func (a *Agent) handleNodes(payload []byte) {
+	var nodes []NodeInfo
+	err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&nodes)
+	if err != nil {
+		a.cluster.logger.Error("node %v: decode nodes error: %v", a.name, err)
+		return
+	}
+
+	c := a.cluster
+	for _, info := range nodes {
+		switch {
+		case info.Name == c.conf.NodeName:
+		case info.Name == a.name:
+			// a may be on standby
+			c.mutexAgents.Lock()
+			a.info = info
+			if other := c.agents[a.name]; other != nil {
+				other.info = info
+			}
+			if other := c.standby[a.name]; other != nil {
+				other.info = info
+			}
+			c.mutexAgents.Unlock()
+		case c.GetAgent(info.Name) != nil:
+		case info.Addr == "":
+		// only one of two nodes dials the other
+		case c.conf.NodeName < info.Name:
+			c.discover(info.Name, info.Addr)
+		}
+	}
+}
+
+// a discovered node is forgotten if it cannot be dialed after so many retries
+const discoverRetries = 3
+
+func (c *Cluster) discover(name string, addr string) {
+	c.mutexDiscovered.Lock()
+	defer c.mutexDiscovered.Unlock()
+	if _, ok := c.discovered[name]; ok {
+		return
+	}
+
+	c.logger.Release("node %v discovered (%v)", name, addr)
+	c.discovered[name] = c.dial(addr, name)
+}
+
+// returns the client of the node
+func (c *Cluster) forget(name string) *network.TCPClient {
+	c.mutexDiscovered.Lock()
+	defer c.mutexDiscovered.Unlock()
+	client := c.discovered[name]
+	delete(c.discovered, name)
+	return client
+}
+
+// a node tells the others that a node is disconnected, so they stop dialing
+// it if they are still dialing it
+func (c *Cluster) broadcastLeave(name string) {
+	msg := append([]byte{msgLeave}, name...)
+
+	c.mutexAgents.RLock()
+	defer c.mutexAgents.RUnlock()
+	for _, a := range c.agents {
+		a.conn.WriteMsg(msg)
+	}
+}
+
+func (a *Agent) handleLeave(payload []byte) {
+	name := string(payload)
+	c := a.cluster
+	if c.GetAgent(name) != nil {
+		return
+	}
+
+	client := c.forget(name)
+	if client == nil {
+		return
+	}
+	a.cluster.logger.Release("node %v left", name)
+	c.removeClient(client)
+	client.Close()
+}
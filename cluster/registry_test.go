@@ -0,0 +1,127 @@
+package cluster
+
+import (
+	"github.com/name5566/leaf/conf"
+	"testing"
+	"time"
+)
+
+// waits until f returns true
+func eventually(t *testing.T, what string, f func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %v", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestGossip(t *testing.T) {
+	a := newNode(t, &conf.Config{NodeName: "a", NodeType: "gate"})
+	b := newNode(t, &conf.Config{NodeName: "b", NodeType: "game", ConnAddrs: []string{a.addr}})
+	a.expect(t, "NodeUp b")
+	b.expect(t, "NodeUp a")
+
+	// join
+	c := newNode(t, &conf.Config{NodeName: "c", NodeType: "game", ConnAddrs: []string{a.addr}})
+	a.expect(t, "NodeUp c")
+	b.expect(t, "NodeUp c")
+	c.expect(t, "NodeUp a", "NodeUp b")
+
+	// the lower-named node dials
+	if ag := b.GetAgent("c"); ag == nil || ag.discovered != "c" {
+		t.Fatal("b did not dial c")
+	}
+	if ag := c.GetAgent("b"); ag == nil || ag.discovered != "" {
+		t.Fatal("c dialed b")
+	}
+
+	nodes := b.Nodes("game")
+	if len(nodes) != 1 || nodes[0].Name != "c" || nodes[0].Addr != c.addr {
+		t.Fatalf("game nodes of b: %+v", nodes)
+	}
+	nodes = c.Nodes("")
+	if len(nodes) != 2 || nodes[0].Name != "a" || nodes[1].Name != "b" {
+		t.Fatalf("nodes of c: %+v", nodes)
+	}
+
+	// load
+	c.SetLoad(7)
+	for _, n := range []*node{a, b} {
+		eventually(t, "load of c", func() bool {
+			info, _ := n.GetNode("c")
+			return info.Load == 7
+		})
+	}
+
+	// leave
+	c.Destroy()
+	a.expect(t, "NodeDown c")
+	b.expect(t, "NodeDown c")
+	if _, ok := b.GetNode("c"); ok {
+		t.Fatal("c is still a node of b")
+	}
+
+	// the client of c is removed, the seed client is kept
+	eventually(t, "the client of c removed", func() bool {
+		return clients(b.Cluster) == 1
+	})
+	if discovered(b.Cluster, "c") {
+		t.Fatal("c is still discovered by b")
+	}
+}
+
+func discovered(c *Cluster, name string) bool {
+	c.mutexDiscovered.Lock()
+	defer c.mutexDiscovered.Unlock()
+	_, ok := c.discovered[name]
+	return ok
+}
+
+func clients(c *Cluster) int {
+	c.mutexClients.Lock()
+	defer c.mutexClients.Unlock()
+	return len(c.clients)
+}
+
+func TestDiscoverGiveUp(t *testing.T) {
+	a := newNode(t, &conf.Config{NodeName: "a"})
+	b := newNode(t, &conf.Config{NodeName: "b", ConnAddrs: []string{a.addr}})
+	a.expect(t, "NodeUp b")
+	b.expect(t, "NodeUp a")
+
+	// b cannot dial c
+	c := newNode(t, &conf.Config{NodeName: "c", AdvertiseAddr: freeAddr(t), ConnAddrs: []string{a.addr}})
+	a.expect(t, "NodeUp c")
+	c.expect(t, "NodeUp a")
+	eventually(t, "c discovered by b", func() bool {
+		return discovered(b.Cluster, "c")
+	})
+	eventually(t, "c forgotten by b", func() bool {
+		return !discovered(b.Cluster, "c") && clients(b.Cluster) == 1
+	})
+}
+
+func TestLeave(t *testing.T) {
+	a := newNode(t, &conf.Config{NodeName: "a"})
+	b := newNode(t, &conf.Config{NodeName: "b", ConnAddrs: []string{a.addr}, ConnectInterval: time.Minute})
+	a.expect(t, "NodeUp b")
+	b.expect(t, "NodeUp a")
+
+	// b is still dialing c when c leaves
+	c := newNode(t, &conf.Config{NodeName: "c", AdvertiseAddr: freeAddr(t), ConnAddrs: []string{a.addr}})
+	a.expect(t, "NodeUp c")
+	eventually(t, "c discovered by b", func() bool {
+		return discovered(b.Cluster, "c")
+	})
+	c.Destroy()
+	a.expect(t, "NodeDown c")
+	eventually(t, "c forgotten by b", func() bool {
+		return !discovered(b.Cluster, "c") && clients(b.Cluster) == 1
+	})
+	if n := len(b.events); n != 0 {
+		t.Fatalf("node b: %v unexpected events", n)
+	}
+}
@@ -1,5 +1,9 @@
 package conf
 
+import (
+	"time"
+)
+
 var (
 	LenStackBuf = 4096
 
@@ -14,7 +18,45 @@ var (
 	ProfilePath   string
 
 	// cluster
-	ListenAddr      string
-	ConnAddrs       []string
-	PendingWriteNum int
+	NodeName          string
+	NodeType          string
+	ListenAddr        string
+	AdvertiseAddr     string
+	ConnAddrs         []string
+	PendingWriteNum   int
+	HeartbeatInterval = 5 * time.Second
+	HeartbeatTimeout  = 15 * time.Second
+	// the interval of dialing a node again
+	ConnectInterval = 3 * time.Second
+
+	// gate, the defaults of the zero fields of gate.Gate
+	WSAddr              string
+	TCPAddr             string
+	MaxConnNum          int
+	GatePendingWriteNum int
+	MaxMsgLen           uint32
+	HTTPTimeout         time.Duration
+	CertFile            string
+	KeyFile             string
+	LenMsgLen           int
+	LittleEndian        bool
+	ReadIdleTimeout     time.Duration
+	WriteIdleTimeout    time.Duration
+
+	// chanrpc
+	DeadlockDetection bool
+
+	// shutdown (no limit if 0)
+	ShutdownTimeout    time.Duration
+	ModuleDrainTimeout time.Duration
+	// module name -> drain timeout
+	ModuleDrainTimeouts map[string]time.Duration
+
+	// module name -> settings, see Module
+	Modules map[string]interface{}
+
+	// reload, set by Load
+	ConfigFile string
+	// the file is not watched if 0
+	ReloadInterval time.Duration
 )
@@ -0,0 +1,145 @@
+package conf
+
+import (
+	"time"
+)
+
+// Config holds the settings of one Leaf server, the package variables hold
+// the settings used by leaf.Run
+type Config struct {
+	// log
+	LogLevel string
+	LogPath  string
+	LogFlag  int
+
+	// console
+	ConsolePort   int
+	ConsolePrompt string
+	ProfilePath   string
+
+	// cluster
+	NodeName          string
+	NodeType          string
+	ListenAddr        string
+	AdvertiseAddr     string
+	ConnAddrs         []string
+	PendingWriteNum   int
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+	// the interval of dialing a node again
+	ConnectInterval time.Duration
+
+	// gate, the defaults of the zero fields of gate.Gate
+	WSAddr              string
+	TCPAddr             string
+	MaxConnNum          int
+	GatePendingWriteNum int
+	MaxMsgLen           uint32
+	HTTPTimeout         time.Duration
+	CertFile            string
+	KeyFile             string
+	LenMsgLen           int
+	LittleEndian        bool
+	ReadIdleTimeout     time.Duration
+	WriteIdleTimeout    time.Duration
+
+	// shutdown (no limit if 0)
+	ShutdownTimeout    time.Duration
+	ModuleDrainTimeout time.Duration
+	// module name -> drain timeout
+	ModuleDrainTimeouts map[string]time.Duration
+
+	// module name -> settings, see Module
+	Modules map[string]interface{}
+
+	// reload, set by Load
+	ConfigFile string
+	// the file is not watched if 0
+	ReloadInterval time.Duration
+}
+
+// a Config with the defaults of the package variables
+func New() *Config {
+	return &Config{
+		ConsolePrompt:     "Leaf# ",
+		HeartbeatInterval: 5 * time.Second,
+		HeartbeatTimeout:  15 * time.Second,
+		ConnectInterval:   3 * time.Second,
+	}
+}
+
+// a Config with the current values of the package variables
+func Global() *Config {
+	return &Config{
+		LogLevel:            LogLevel,
+		LogPath:             LogPath,
+		LogFlag:             LogFlag,
+		ConsolePort:         ConsolePort,
+		ConsolePrompt:       ConsolePrompt,
+		ProfilePath:         ProfilePath,
+		NodeName:            NodeName,
+		NodeType:            NodeType,
+		ListenAddr:          ListenAddr,
+		AdvertiseAddr:       AdvertiseAddr,
+		ConnAddrs:           ConnAddrs,
+		PendingWriteNum:     PendingWriteNum,
+		HeartbeatInterval:   HeartbeatInterval,
+		HeartbeatTimeout:    HeartbeatTimeout,
+		ConnectInterval:     ConnectInterval,
+		WSAddr:              WSAddr,
+		TCPAddr:             TCPAddr,
+		MaxConnNum:          MaxConnNum,
+		GatePendingWriteNum: GatePendingWriteNum,
+		MaxMsgLen:           MaxMsgLen,
+		HTTPTimeout:         HTTPTimeout,
+		CertFile:            CertFile,
+		KeyFile:             KeyFile,
+		LenMsgLen:           LenMsgLen,
+		LittleEndian:        LittleEndian,
+		ReadIdleTimeout:     ReadIdleTimeout,
+		WriteIdleTimeout:    WriteIdleTimeout,
+		ShutdownTimeout:     ShutdownTimeout,
+		ModuleDrainTimeout:  ModuleDrainTimeout,
+		ModuleDrainTimeouts: ModuleDrainTimeouts,
+		Modules:             Modules,
+		ConfigFile:          ConfigFile,
+		ReloadInterval:      ReloadInterval,
+	}
+}
+
+// sets the package variables
+func setGlobal(c *Config) {
+	LogLevel = c.LogLevel
+	LogPath = c.LogPath
+	LogFlag = c.LogFlag
+	ConsolePort = c.ConsolePort
+	ConsolePrompt = c.ConsolePrompt
+	ProfilePath = c.ProfilePath
+	NodeName = c.NodeName
+	NodeType = c.NodeType
+	ListenAddr = c.ListenAddr
+	AdvertiseAddr = c.AdvertiseAddr
+	ConnAddrs = c.ConnAddrs
+	PendingWriteNum = c.PendingWriteNum
+	HeartbeatInterval = c.HeartbeatInterval
+	HeartbeatTimeout = c.HeartbeatTimeout
+	ConnectInterval = c.ConnectInterval
+	WSAddr = c.WSAddr
+	TCPAddr = c.TCPAddr
+	MaxConnNum = c.MaxConnNum
+	GatePendingWriteNum = c.GatePendingWriteNum
+	MaxMsgLen = c.MaxMsgLen
+	HTTPTimeout = c.HTTPTimeout
+	CertFile = c.CertFile
+	KeyFile = c.KeyFile
+	LenMsgLen = c.LenMsgLen
+	LittleEndian = c.LittleEndian
+	ReadIdleTimeout = c.ReadIdleTimeout
+	WriteIdleTimeout = c.WriteIdleTimeout
+	ShutdownTimeout = c.ShutdownTimeout
+	ModuleDrainTimeout = c.ModuleDrainTimeout
+	ModuleDrainTimeouts = c.ModuleDrainTimeouts
+	Modules = c.Modules
+	ConfigFile = c.ConfigFile
+	ReloadInterval = c.ReloadInterval
+}
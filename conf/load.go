@@ -0,0 +1,521 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a setting is "section.key" in a file and LEAF_SECTION_KEY in the
+// environment, e.g. cluster.node_name and LEAF_CLUSTER_NODE_NAME
+//
+// durations are strings such as "5s", a list in the environment is separated
+// by commas and a map is name=value pairs separated by commas
+var settings = []struct {
+	key   string
+	field func(c *Config) interface{}
+}{
+	// log
+	{"log.level", func(c *Config) interface{} { return &c.LogLevel }},
+	{"log.path", func(c *Config) interface{} { return &c.LogPath }},
+	{"log.flag", func(c *Config) interface{} { return &c.LogFlag }},
+
+	// console
+	{"console.port", func(c *Config) interface{} { return &c.ConsolePort }},
+	{"console.prompt", func(c *Config) interface{} { return &c.ConsolePrompt }},
+	{"console.profile_path", func(c *Config) interface{} { return &c.ProfilePath }},
+
+	// cluster
+	{"cluster.node_name", func(c *Config) interface{} { return &c.NodeName }},
+	{"cluster.node_type", func(c *Config) interface{} { return &c.NodeType }},
+	{"cluster.listen_addr", func(c *Config) interface{} { return &c.ListenAddr }},
+	{"cluster.advertise_addr", func(c *Config) interface{} { return &c.AdvertiseAddr }},
+	{"cluster.conn_addrs", func(c *Config) interface{} { return &c.ConnAddrs }},
+	{"cluster.pending_write_num", func(c *Config) interface{} { return &c.PendingWriteNum }},
+	{"cluster.heartbeat_interval", func(c *Config) interface{} { return &c.HeartbeatInterval }},
+	{"cluster.heartbeat_timeout", func(c *Config) interface{} { return &c.HeartbeatTimeout }},
+	{"cluster.connect_interval", func(c *Config) interface{} { return &c.ConnectInterval }},
+
+	// gate
+	{"gate.ws_addr", func(c *Config) interface{} { return &c.WSAddr }},
+	{"gate.tcp_addr", func(c *Config) interface{} { return &c.TCPAddr }},
+	{"gate.max_conn_num", func(c *Config) interface{} { return &c.MaxConnNum }},
+	{"gate.pending_write_num", func(c *Config) interface{} { return &c.GatePendingWriteNum }},
+	{"gate.max_msg_len", func(c *Config) interface{} { return &c.MaxMsgLen }},
+	{"gate.http_timeout", func(c *Config) interface{} { return &c.HTTPTimeout }},
+	{"gate.cert_file", func(c *Config) interface{} { return &c.CertFile }},
+	{"gate.key_file", func(c *Config) interface{} { return &c.KeyFile }},
+	{"gate.len_msg_len", func(c *Config) interface{} { return &c.LenMsgLen }},
+	{"gate.little_endian", func(c *Config) interface{} { return &c.LittleEndian }},
+	{"gate.read_idle_timeout", func(c *Config) interface{} { return &c.ReadIdleTimeout }},
+	{"gate.write_idle_timeout", func(c *Config) interface{} { return &c.WriteIdleTimeout }},
+
+	// shutdown
+	{"shutdown.timeout", func(c *Config) interface{} { return &c.ShutdownTimeout }},
+	{"shutdown.module_drain_timeout", func(c *Config) interface{} { return &c.ModuleDrainTimeout }},
+	{"shutdown.module_drain_timeouts", func(c *Config) interface{} { return &c.ModuleDrainTimeouts }},
+
+	// reload
+	{"reload.interval", func(c *Config) interface{} { return &c.ReloadInterval }},
+}
+
+// the modules section, e.g. modules.game holds the settings of the module game
+const modulesKey = "modules"
+
+// loads the package variables, see Config.Load
+func Load(filename string) error {
+	c := Global()
+	err := c.Load(filename)
+	if err != nil {
+		return err
+	}
+
+	setGlobal(c)
+	return nil
+}
+
+// loads the settings from the file (JSON, TOML or YAML by the extension) and
+// then from the environment, no file is loaded if filename is empty
+// TOML and YAML are decoded by github.com/BurntSushi/toml and gopkg.in/yaml.v2
+// the settings not found are kept
+func (c *Config) Load(filename string) error {
+	if filename != "" {
+		err := c.loadFile(filename)
+		if err != nil {
+			return err
+		}
+		c.ConfigFile = filename
+	}
+
+	err := c.loadEnv()
+	if err != nil {
+		return err
+	}
+
+	return c.Validate()
+}
+
+func (c *Config) loadFile(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var m map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".json":
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		err = d.Decode(&m)
+	case ".toml":
+		_, err = toml.Decode(string(data), &m)
+	case ".yaml", ".yml":
+		var y interface{}
+		err = yaml.Unmarshal(data, &y)
+		if err == nil && y != nil {
+			var ok bool
+			m, ok = normalize(y).(map[string]interface{})
+			if !ok {
+				err = fmt.Errorf("expected a mapping, got %T", y)
+			}
+		}
+	default:
+		return fmt.Errorf("%v: unknown config format %v", filename, ext)
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %v", filename, err)
+	}
+
+	err = c.set(m)
+	if err != nil {
+		return fmt.Errorf("%v: %v", filename, err)
+	}
+	return nil
+}
+
+// yaml decodes mappings as map[interface{}]interface{}
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = normalize(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = normalize(e)
+		}
+	}
+
+	return v
+}
+
+func (c *Config) set(m map[string]interface{}) error {
+	for _, section := range sortedKeys(m) {
+		sub, ok := m[section].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%v: expected a section, got %T", section, m[section])
+		}
+
+		if section == modulesKey {
+			modules := make(map[string]interface{})
+			for name, v := range c.Modules {
+				modules[name] = v
+			}
+			for name, v := range sub {
+				modules[name] = v
+			}
+			c.Modules = modules
+			continue
+		}
+
+		for _, k := range sortedKeys(sub) {
+			key := section + "." + k
+			field := c.field(key)
+			if field == nil {
+				return fmt.Errorf("unknown key %v", key)
+			}
+			err := setValue(field, sub[k])
+			if err != nil {
+				return fmt.Errorf("%v: %v", key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	for _, s := range settings {
+		name := envName(s.key)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		err := parseValue(s.field(c), value)
+		if err != nil {
+			return fmt.Errorf("%v (%v): %v", s.key, name, err)
+		}
+	}
+
+	return nil
+}
+
+func envName(key string) string {
+	return "LEAF_" + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+func (c *Config) field(key string) interface{} {
+	for _, s := range settings {
+		if s.key == key {
+			return s.field(c)
+		}
+	}
+
+	return nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sets a value decoded from a file
+func setValue(field interface{}, v interface{}) error {
+	switch p := field.(type) {
+	case *string:
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("expected a string, got %T", v)
+		}
+		*p = s
+	case *int:
+		n, err := toInt(v, math.MinInt32, math.MaxInt32)
+		if err != nil {
+			return err
+		}
+		*p = int(n)
+	case *uint32:
+		n, err := toInt(v, 0, math.MaxUint32)
+		if err != nil {
+			return err
+		}
+		*p = uint32(n)
+	case *bool:
+		b, ok := v.(bool)
+		if !ok {
+			return fmt.Errorf("expected a bool, got %T", v)
+		}
+		*p = b
+	case *time.Duration:
+		d, err := toDuration(v)
+		if err != nil {
+			return err
+		}
+		*p = d
+	case *[]string:
+		l, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("expected a list, got %T", v)
+		}
+		ss := make([]string, len(l))
+		for i, e := range l {
+			s, ok := e.(string)
+			if !ok {
+				return fmt.Errorf("[%v]: expected a string, got %T", i, e)
+			}
+			ss[i] = s
+		}
+		*p = ss
+	case *map[string]time.Duration:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected a map, got %T", v)
+		}
+		dm := make(map[string]time.Duration, len(m))
+		for k, e := range m {
+			d, err := toDuration(e)
+			if err != nil {
+				return fmt.Errorf("%v: %v", k, err)
+			}
+			dm[k] = d
+		}
+		*p = dm
+	default:
+		panic(fmt.Sprintf("unsupported setting type %T", field))
+	}
+
+	return nil
+}
+
+func toInt(v interface{}, min int64, max int64) (int64, error) {
+	var n int64
+	switch v := v.(type) {
+	case json.Number:
+		var err error
+		n, err = v.Int64()
+		if err != nil {
+			return 0, fmt.Errorf("expected an integer, got %v", v)
+		}
+	case int:
+		n = int64(v)
+	case int64:
+		n = v
+	case uint64:
+		if v > math.MaxInt64 {
+			return 0, fmt.Errorf("%v out of range", v)
+		}
+		n = int64(v)
+	default:
+		return 0, fmt.Errorf("expected an integer, got %T", v)
+	}
+
+	if n < min || n > max {
+		return 0, fmt.Errorf("%v out of range", n)
+	}
+	return n, nil
+}
+
+func toDuration(v interface{}) (time.Duration, error) {
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("expected a duration such as \"5s\", got %T", v)
+	}
+
+	return time.ParseDuration(s)
+}
+
+// sets a value from the environment
+func parseValue(field interface{}, s string) error {
+	switch p := field.(type) {
+	case *string:
+		*p = s
+	case *int:
+		n, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", s)
+		}
+		*p = int(n)
+	case *uint32:
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return fmt.Errorf("expected an unsigned integer, got %q", s)
+		}
+		*p = uint32(n)
+	case *bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("expected a bool, got %q", s)
+		}
+		*p = b
+	case *time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*p = d
+	case *[]string:
+		var ss []string
+		for _, e := range strings.Split(s, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				ss = append(ss, e)
+			}
+		}
+		*p = ss
+	case *map[string]time.Duration:
+		dm := make(map[string]time.Duration)
+		for _, e := range strings.Split(s, ",") {
+			if e = strings.TrimSpace(e); e == "" {
+				continue
+			}
+			kv := strings.SplitN(e, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("expected name=duration, got %q", e)
+			}
+			d, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+			if err != nil {
+				return fmt.Errorf("%v: %v", strings.TrimSpace(kv[0]), err)
+			}
+			dm[strings.TrimSpace(kv[0])] = d
+		}
+		*p = dm
+	default:
+		panic(fmt.Sprintf("unsupported setting type %T", field))
+	}
+
+	return nil
+}
+
+// the error names the key of the invalid setting
+func (c *Config) Validate() error {
+	switch strings.ToLower(c.LogLevel) {
+	case "", "debug", "release", "error", "fatal":
+	default:
+		return fmt.Errorf("log.level: unknown level %v", c.LogLevel)
+	}
+	if c.ConsolePort < 0 || c.ConsolePort > math.MaxUint16 {
+		return fmt.Errorf("console.port: %v out of range", c.ConsolePort)
+	}
+
+	if (c.ListenAddr != "" || len(c.ConnAddrs) > 0) && c.NodeName == "" {
+		return fmt.Errorf("cluster.node_name: must not be empty")
+	}
+	addrs := [][2]string{
+		{"cluster.listen_addr", c.ListenAddr},
+		{"cluster.advertise_addr", c.AdvertiseAddr},
+		{"gate.ws_addr", c.WSAddr},
+		{"gate.tcp_addr", c.TCPAddr},
+	}
+	for i, addr := range c.ConnAddrs {
+		addrs = append(addrs, [2]string{fmt.Sprintf("cluster.conn_addrs[%v]", i), addr})
+	}
+	for _, a := range addrs {
+		if a[1] == "" {
+			continue
+		}
+		_, _, err := net.SplitHostPort(a[1])
+		if err != nil {
+			return fmt.Errorf("%v: %v", a[0], err)
+		}
+	}
+
+	ints := []struct {
+		key string
+		n   int
+	}{
+		{"cluster.pending_write_num", c.PendingWriteNum},
+		{"gate.max_conn_num", c.MaxConnNum},
+		{"gate.pending_write_num", c.GatePendingWriteNum},
+	}
+	for _, i := range ints {
+		if i.n < 0 {
+			return fmt.Errorf("%v: must not be negative", i.key)
+		}
+	}
+	switch c.LenMsgLen {
+	case 0, 1, 2, 4:
+	default:
+		return fmt.Errorf("gate.len_msg_len: must be 1, 2 or 4")
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("gate.cert_file: cert_file and key_file must be set together")
+	}
+
+	durations := []struct {
+		key string
+		d   time.Duration
+	}{
+		{"cluster.heartbeat_interval", c.HeartbeatInterval},
+		{"cluster.heartbeat_timeout", c.HeartbeatTimeout},
+		{"cluster.connect_interval", c.ConnectInterval},
+		{"gate.http_timeout", c.HTTPTimeout},
+		{"gate.read_idle_timeout", c.ReadIdleTimeout},
+		{"gate.write_idle_timeout", c.WriteIdleTimeout},
+		{"shutdown.timeout", c.ShutdownTimeout},
+		{"shutdown.module_drain_timeout", c.ModuleDrainTimeout},
+		{"reload.interval", c.ReloadInterval},
+	}
+	for _, d := range durations {
+		if d.d < 0 {
+			return fmt.Errorf("%v: must not be negative", d.key)
+		}
+	}
+	for name, d := range c.ModuleDrainTimeouts {
+		if d < 0 {
+			return fmt.Errorf("shutdown.module_drain_timeouts.%v: must not be negative", name)
+		}
+	}
+	if c.HeartbeatTimeout > 0 && c.HeartbeatTimeout < c.HeartbeatInterval {
+		return fmt.Errorf("cluster.heartbeat_timeout: must not be less than heartbeat_interval")
+	}
+
+	return nil
+}
+
+// decodes the settings of the module loaded from the file (modules.name) into
+// v as encoding/json does, e.g. v is a pointer to a struct with json tags
+// v is kept if there are no settings
+func Module(name string, v interface{}) error {
+	return module(Modules, name, v)
+}
+
+func (c *Config) Module(name string, v interface{}) error {
+	return module(c.Modules, name, v)
+}
+
+func module(modules map[string]interface{}, name string, v interface{}) error {
+	settings, ok := modules[name]
+	if !ok {
+		return nil
+	}
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("%v.%v: %v", modulesKey, name, err)
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	err = d.Decode(v)
+	if err != nil {
+		return fmt.Errorf("%v.%v: %v", modulesKey, name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package conf_test
+
+import (
+	"github.com/name5566/leaf/conf"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name string, data string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	err := ioutil.WriteFile(filename, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+type gameConf struct {
+	MaxRooms int `json:"max_rooms"`
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"leaf.json", `{
+			"log": {"level": "release"},
+			"cluster": {"node_name": "game1", "conn_addrs": ["127.0.0.1:3001"], "heartbeat_interval": "2s"},
+			"gate": {"max_conn_num": 100},
+			"modules": {"game": {"max_rooms": 10}}
+		}`},
+		{"leaf.toml", `
+			[log]
+			level = "release"
+			[cluster]
+			node_name = "game1"
+			conn_addrs = ["127.0.0.1:3001"]
+			heartbeat_interval = "2s"
+			[gate]
+			max_conn_num = 100
+			[modules.game]
+			max_rooms = 10
+		`},
+		{"leaf.yaml", `
+log:
+  level: release
+cluster:
+  node_name: game1
+  conn_addrs: [127.0.0.1:3001]
+  heartbeat_interval: 2s
+gate:
+  max_conn_num: 100
+modules:
+  game:
+    max_rooms: 10
+`},
+	}
+
+	for _, test := range tests {
+		filename := writeFile(t, test.name, test.data)
+		c := conf.New()
+		err := c.Load(filename)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		if c.LogLevel != "release" ||
+			c.NodeName != "game1" ||
+			!reflect.DeepEqual(c.ConnAddrs, []string{"127.0.0.1:3001"}) ||
+			c.HeartbeatInterval != 2*time.Second ||
+			c.MaxConnNum != 100 ||
+			c.ConfigFile != filename {
+			t.Errorf("%v: unexpected config %+v", test.name, c)
+		}
+		// not in the file
+		if c.HeartbeatTimeout != 15*time.Second {
+			t.Errorf("%v: HeartbeatTimeout %v not kept", test.name, c.HeartbeatTimeout)
+		}
+
+		var g gameConf
+		err = c.Module("game", &g)
+		if err != nil || g.MaxRooms != 10 {
+			t.Errorf("%v: module game %+v: %v", test.name, g, err)
+		}
+	}
+}
+
+func TestLoadError(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"unknown.json", `{"log": {"levle": "debug"}}`, "unknown key log.levle"},
+		{"type.json", `{"gate": {"max_conn_num": "many"}}`, "gate.max_conn_num"},
+		{"range.yaml", "console:\n  port: 99999\n", "console.port"},
+		{"section.toml", `log = 1`, "log: expected a section"},
+		{"leaf.ini", ``, "unknown config format"},
+	}
+
+	for _, test := range tests {
+		filename := writeFile(t, test.name, test.data)
+		err := conf.New().Load(filename)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	filename := writeFile(t, "leaf.json", `{"log": {"level": "release"}, "cluster": {"node_name": "game1"}}`)
+	t.Setenv("LEAF_LOG_LEVEL", "error")
+	t.Setenv("LEAF_CLUSTER_CONN_ADDRS", "127.0.0.1:3001, 127.0.0.1:3002")
+	t.Setenv("LEAF_SHUTDOWN_MODULE_DRAIN_TIMEOUTS", "game=1s,gate=2s")
+
+	c := conf.New()
+	err := c.Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.LogLevel != "error" {
+		t.Errorf("LogLevel %v, want error", c.LogLevel)
+	}
+	if c.NodeName != "game1" {
+		t.Errorf("NodeName %v, want game1", c.NodeName)
+	}
+	if !reflect.DeepEqual(c.ConnAddrs, []string{"127.0.0.1:3001", "127.0.0.1:3002"}) {
+		t.Errorf("ConnAddrs %v", c.ConnAddrs)
+	}
+	if !reflect.DeepEqual(c.ModuleDrainTimeouts, map[string]time.Duration{"game": time.Second, "gate": 2 * time.Second}) {
+		t.Errorf("ModuleDrainTimeouts %v", c.ModuleDrainTimeouts)
+	}
+
+	t.Setenv("LEAF_CONSOLE_PORT", "abc")
+	err = conf.New().Load(filename)
+	if err == nil || !strings.Contains(err.Error(), "LEAF_CONSOLE_PORT") {
+		t.Errorf("got %v, want an error of LEAF_CONSOLE_PORT", err)
+	}
+}
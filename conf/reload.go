@@ -0,0 +1,192 @@
+package conf
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a chanrpc.Server
+type Subscriber interface {
+	Go(id interface{}, args ...interface{})
+}
+
+// f is called on the goroutine reloading the config
+type SubscriberFunc func(c *Config, old *Config)
+
+func (f SubscriberFunc) Go(id interface{}, args ...interface{}) {
+	f(args[0].(*Config), args[1].(*Config))
+}
+
+// a Reloader holds the config which is reloaded from the file of the config
+// (see Config.ConfigFile), the subscribers receive ConfigReload with the new and
+// the old *Config arguments, the configs must not be modified
+type Reloader struct {
+	base        *Config
+	current     atomic.Value
+	subscribers []Subscriber
+	mutex       sync.Mutex
+	modTime     time.Time
+	closeChan   chan struct{}
+}
+
+// the package level functions use the reloader of leaf.Run
+var std = NewReloader(nil)
+
+// the reloader of leaf.Run
+func DefaultReloader() *Reloader {
+	return std
+}
+
+// the package variables are used if c is nil, the settings not found in the
+// file or the environment when reloading are those of c
+func NewReloader(c *Config) *Reloader {
+	r := new(Reloader)
+	r.base = c
+	if c != nil {
+		r.current.Store(c)
+	}
+	return r
+}
+
+// goroutine safe
+func Current() *Config {
+	return std.Config()
+}
+
+// goroutine safe
+func (r *Reloader) Config() *Config {
+	if c, ok := r.current.Load().(*Config); ok {
+		return c
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.initBase()
+	return r.current.Load().(*Config)
+}
+
+// must be called with the mutex held
+func (r *Reloader) initBase() {
+	if r.base == nil {
+		r.base = Global()
+		r.current.Store(r.base)
+	}
+}
+
+// goroutine safe
+func Subscribe(s Subscriber) {
+	std.Subscribe(s)
+}
+
+// goroutine safe
+func (r *Reloader) Subscribe(s Subscriber) {
+	r.mutex.Lock()
+	r.subscribers = append(r.subscribers, s)
+	r.mutex.Unlock()
+}
+
+// goroutine safe
+func Reload() error {
+	return std.Reload()
+}
+
+// the current config is kept if an error is returned
+// goroutine safe
+func (r *Reloader) Reload() error {
+	r.mutex.Lock()
+	r.initBase()
+	c, old, err := r.load()
+	subscribers := r.subscribers
+	r.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range subscribers {
+		s.Go("ConfigReload", c, old)
+	}
+	return nil
+}
+
+// must be called with the mutex held
+func (r *Reloader) load() (c *Config, old *Config, err error) {
+	if r.base.ConfigFile == "" {
+		return nil, nil, errors.New("no config file")
+	}
+	if fi, err := os.Stat(r.base.ConfigFile); err == nil {
+		r.modTime = fi.ModTime()
+	}
+
+	c = new(Config)
+	*c = *r.base
+	err = c.Load(r.base.ConfigFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	old = r.current.Load().(*Config)
+	r.current.Store(c)
+	return c, old, nil
+}
+
+// reloads the config when the file is modified, the file is checked every
+// interval until Close is called
+// goroutine safe
+func (r *Reloader) Watch(interval time.Duration, onError func(err error)) {
+	r.mutex.Lock()
+	if r.closeChan == nil {
+		r.closeChan = make(chan struct{})
+	}
+	closeChan := r.closeChan
+	r.mutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-closeChan:
+				return
+			case <-ticker.C:
+			}
+
+			if !r.modified() {
+				continue
+			}
+			err := r.Reload()
+			if err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}()
+}
+
+func (r *Reloader) modified() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.initBase()
+	fi, err := os.Stat(r.base.ConfigFile)
+	if err != nil {
+		return false
+	}
+	if r.modTime.IsZero() {
+		r.modTime = fi.ModTime()
+		return false
+	}
+	return !fi.ModTime().Equal(r.modTime)
+}
+
+// stops watching
+// goroutine safe
+func (r *Reloader) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closeChan != nil {
+		close(r.closeChan)
+		r.closeChan = nil
+	}
+}
@@ -0,0 +1,186 @@
+package conf_test
+
+import (
+	"github.com/name5566/leaf/conf"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// records the notifications
+type notifications chan [2]*conf.Config
+
+func (n notifications) subscriber() conf.Subscriber {
+	return conf.SubscriberFunc(func(c *conf.Config, old *conf.Config) {
+		n <- [2]*conf.Config{c, old}
+	})
+}
+
+func (n notifications) next(t *testing.T) (*conf.Config, *conf.Config) {
+	t.Helper()
+	select {
+	case cs := <-n:
+		return cs[0], cs[1]
+	case <-time.After(time.Second):
+		t.Fatal("not notified")
+		return nil, nil
+	}
+}
+
+func rewrite(t *testing.T, filename string, data string) {
+	err := ioutil.WriteFile(filename, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	filename := writeFile(t, "leaf.json", `{"log": {"level": "release"}, "gate": {"max_conn_num": 100}}`)
+	base := conf.New()
+	base.NodeName = "game1"
+	base.MaxConnNum = 10
+	base.ConfigFile = filename
+
+	r := conf.NewReloader(base)
+	n := make(notifications, 10)
+	r.Subscribe(n.subscriber())
+	if r.Config() != base {
+		t.Fatal("the base config is not current")
+	}
+
+	// the settings not in the file are those of the base config
+	err := r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, old := n.next(t)
+	if old != base || r.Config() != c {
+		t.Fatal("the reloaded config is not current")
+	}
+	if c.LogLevel != "release" || c.MaxConnNum != 100 || c.NodeName != "game1" {
+		t.Fatalf("reloaded %+v", c)
+	}
+	if base.LogLevel != "" || base.MaxConnNum != 10 {
+		t.Fatalf("the base config is modified: %+v", base)
+	}
+
+	// not merged with the previous config
+	rewrite(t, filename, `{"gate": {"max_conn_num": 200}}`)
+	err = r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, old := n.next(t)
+	if old != c || r.Config() != c2 {
+		t.Fatal("the reloaded config is not current")
+	}
+	if c2.LogLevel != "" || c2.MaxConnNum != 200 || c2.NodeName != "game1" {
+		t.Fatalf("reloaded %+v", c2)
+	}
+
+	// the current config is kept
+	for _, data := range []string{`{"gate": {`, `{"gate": {"max_conn_num": "many"}}`} {
+		rewrite(t, filename, data)
+		err = r.Reload()
+		if err == nil {
+			t.Fatalf("%v reloaded", data)
+		}
+		if r.Config() != c2 {
+			t.Fatalf("%v: the current config is replaced", data)
+		}
+	}
+	os.Remove(filename)
+	err = r.Reload()
+	if err == nil || r.Config() != c2 {
+		t.Fatalf("a removed file reloaded: %v", err)
+	}
+	if len(n) != 0 {
+		t.Fatalf("%v unexpected notifications", len(n))
+	}
+
+	err = conf.NewReloader(conf.New()).Reload()
+	if err == nil {
+		t.Fatal("reloaded without a config file")
+	}
+}
+
+// the readers see either config
+func TestReloadSwap(t *testing.T) {
+	filename := writeFile(t, "leaf.json", `{"gate": {"max_conn_num": 100}}`)
+	base := conf.New()
+	base.MaxConnNum = 100
+	base.ConfigFile = filename
+	r := conf.NewReloader(base)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if n := r.Config().MaxConnNum; n != 100 && n != 200 {
+					t.Errorf("MaxConnNum %v", n)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		data := `{"gate": {"max_conn_num": 100}}`
+		if i%2 == 1 {
+			data = `{"gate": {"max_conn_num": 200}}`
+		}
+		rewrite(t, filename, data)
+		err := r.Reload()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestWatch(t *testing.T) {
+	filename := writeFile(t, "leaf.json", `{"gate": {"max_conn_num": 100}}`)
+	base := conf.New()
+	base.ConfigFile = filename
+	r := conf.NewReloader(base)
+	n := make(notifications, 10)
+	r.Subscribe(n.subscriber())
+	errs := make(chan error, 10)
+	r.Watch(10*time.Millisecond, func(err error) {
+		errs <- err
+	})
+	defer r.Close()
+
+	// the file is modified once watched
+	time.Sleep(50 * time.Millisecond)
+	rewrite(t, filename, `{"gate": {"max_conn_num": 200}}`)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(filename, later, later)
+	c, _ := n.next(t)
+	if c.MaxConnNum != 200 {
+		t.Fatalf("reloaded %+v", c)
+	}
+
+	rewrite(t, filename, `{"gate": {`)
+	later = later.Add(time.Second)
+	os.Chtimes(filename, later, later)
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatal("the error is not reported")
+	}
+	if r.Config() != c {
+		t.Fatal("the current config is replaced")
+	}
+}
@@ -3,20 +3,13 @@ package console
 import (
 	"fmt"
 	"github.com/name5566/leaf/chanrpc"
-	"github.com/name5566/leaf/conf"
-	"github.com/name5566/leaf/log"
 	"os"
 	"path"
 	"runtime/pprof"
+	"strings"
 	"time"
 )
 
-var commands = []Command{
-	new(CommandHelp),
-	new(CommandCPUProf),
-	new(CommandProf),
-}
-
 type Command interface {
 	// must goroutine safe
 	name() string
@@ -61,23 +54,73 @@ func (c *ExternalCommand) run(_args []string) string {
 // you must call the function before calling console.Init
 // goroutine not safe
 func Register(name string, help string, f interface{}, server *chanrpc.Server) {
-	for _, c := range commands {
-		if c.name() == name {
-			log.Fatal("command %v is already registered", name)
+	std.Register(name, help, f, server)
+}
+
+// you must call the function before calling Init
+// goroutine not safe
+func (c *Console) Register(name string, help string, f interface{}, server *chanrpc.Server) {
+	c.checkName(name)
+
+	server.Register(name, f)
+
+	cmd := new(ExternalCommand)
+	cmd._name = name
+	cmd._help = help
+	cmd.server = server
+	c.commands = append(c.commands, cmd)
+}
+
+// f must goroutine safe
+// you must call the function before calling console.Init
+// goroutine not safe
+func RegisterFunc(name string, help string, f func(args []string) string) {
+	std.RegisterFunc(name, help, f)
+}
+
+// f must goroutine safe
+// you must call the function before calling Init
+// goroutine not safe
+func (c *Console) RegisterFunc(name string, help string, f func(args []string) string) {
+	c.checkName(name)
+
+	cmd := new(FuncCommand)
+	cmd._name = name
+	cmd._help = help
+	cmd.f = f
+	c.commands = append(c.commands, cmd)
+}
+
+func (c *Console) checkName(name string) {
+	for _, cmd := range c.commands {
+		if cmd.name() == name {
+			c.logger.Fatal("command %v is already registered", name)
 		}
 	}
+}
 
-	server.Register(name, f)
+type FuncCommand struct {
+	_name string
+	_help string
+	f     func(args []string) string
+}
+
+func (c *FuncCommand) name() string {
+	return c._name
+}
 
-	c := new(ExternalCommand)
-	c._name = name
-	c._help = help
-	c.server = server
-	commands = append(commands, c)
+func (c *FuncCommand) help() string {
+	return c._help
+}
+
+func (c *FuncCommand) run(args []string) string {
+	return c.f(args)
 }
 
 // help
-type CommandHelp struct{}
+type CommandHelp struct {
+	console *Console
+}
 
 func (c *CommandHelp) name() string {
 	return "help"
@@ -89,8 +132,8 @@ func (c *CommandHelp) help() string {
 
 func (c *CommandHelp) run([]string) string {
 	output := "Commands:\r\n"
-	for _, c := range commands {
-		output += c.name() + " - " + c.help() + "\r\n"
+	for _, cmd := range c.console.commands {
+		output += cmd.name() + " - " + cmd.help() + "\r\n"
 	}
 	output += "quit - exit console"
 
@@ -98,7 +141,9 @@ func (c *CommandHelp) run([]string) string {
 }
 
 // cpuprof
-type CommandCPUProf struct{}
+type CommandCPUProf struct {
+	console *Console
+}
 
 func (c *CommandCPUProf) name() string {
 	return "cpuprof"
@@ -123,7 +168,7 @@ func (c *CommandCPUProf) run(args []string) string {
 
 	switch args[0] {
 	case "start":
-		fn := profileName() + ".cpuprof"
+		fn := c.console.profileName() + ".cpuprof"
 		f, err := os.Create(fn)
 		if err != nil {
 			return err.Error()
@@ -142,9 +187,9 @@ func (c *CommandCPUProf) run(args []string) string {
 	}
 }
 
-func profileName() string {
+func (c *Console) profileName() string {
 	now := time.Now()
-	return path.Join(conf.ProfilePath,
+	return path.Join(c.conf.ProfilePath,
 		fmt.Sprintf("%d%02d%02d_%02d_%02d_%02d",
 			now.Year(),
 			now.Month(),
@@ -155,7 +200,9 @@ func profileName() string {
 }
 
 // prof
-type CommandProf struct{}
+type CommandProf struct {
+	console *Console
+}
 
 func (c *CommandProf) name() string {
 	return "prof"
@@ -184,6 +231,7 @@ func (c *CommandProf) run(args []string) string {
 		p  *pprof.Profile
 		fn string
 	)
+	profileName := c.console.profileName
 	switch args[0] {
 	case "goroutine":
 		p = pprof.Lookup("goroutine")
@@ -213,3 +261,43 @@ func (c *CommandProf) run(args []string) string {
 
 	return fn
 }
+
+// chanrpc
+type CommandChanRPC struct{}
+
+func (c *CommandChanRPC) name() string {
+	return "chanrpc"
+}
+
+func (c *CommandChanRPC) help() string {
+	return "statistics of the chanrpc servers"
+}
+
+func (c *CommandChanRPC) usage() string {
+	return "chanrpc prints the statistics of the chanrpc servers\r\n\r\n" +
+		"Usage: chanrpc [name]\r\n" +
+		"  name - prints the servers with the name only"
+}
+
+func (c *CommandChanRPC) run(args []string) string {
+	if len(args) > 1 {
+		return c.usage()
+	}
+
+	var output string
+	for _, s := range chanrpc.Servers() {
+		st := s.Stats()
+		if len(args) == 1 && st.Name != args[0] {
+			continue
+		}
+
+		output += fmt.Sprintf("%v: queue %v/%v, rejected %v\r\n",
+			st.Name, st.QueueLen, st.QueueCap, st.Rejections)
+		for _, f := range st.Funcs {
+			output += fmt.Sprintf("  %v: calls %v, errors %v, panics %v, avg %v, p99 %v\r\n",
+				f.ID, f.Calls, f.Errors, f.Panics, f.AvgTime, f.P99Time)
+		}
+	}
+
+	return strings.TrimSuffix(output, "\r\n")
+}
@@ -3,50 +3,108 @@ package console
 import (
 	"bufio"
 	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/log"
 	"github.com/name5566/leaf/network"
 	"math"
 	"strconv"
 	"strings"
 )
 
-var server *network.TCPServer
+// a Console is the console of one server
+type Console struct {
+	conf     *conf.Config
+	logger   *log.Logger
+	commands []Command
+	server   *network.TCPServer
+}
+
+// the package level functions use the console of leaf.Run
+var std = New(nil)
+
+// the console of leaf.Run
+func Default() *Console {
+	return std
+}
+
+// the settings of the package conf are used if c is nil
+func New(c *conf.Config) *Console {
+	console := new(Console)
+	console.conf = c
+	console.commands = []Command{
+		&CommandHelp{console: console},
+		&CommandCPUProf{console: console},
+		&CommandProf{console: console},
+		new(CommandChanRPC),
+	}
+	return console
+}
 
 func Init() {
-	if conf.ConsolePort == 0 {
-		return
+	err := std.Init()
+	if err != nil {
+		log.Fatal("%v", err)
 	}
+}
 
-	server = new(network.TCPServer)
-	server.Addr = "localhost:" + strconv.Itoa(conf.ConsolePort)
-	server.MaxConnNum = int(math.MaxInt32)
-	server.PendingWriteNum = 100
-	server.NewAgent = newAgent
+func Destroy() {
+	std.Destroy()
+}
 
-	server.Start()
+// the logger of the package log is used if not called
+// you must call the function before calling Init
+func (c *Console) SetLogger(logger *log.Logger) {
+	c.logger = logger
 }
 
-func Destroy() {
-	if server != nil {
-		server.Close()
+func (c *Console) Init() error {
+	if c.conf == nil {
+		c.conf = conf.Global()
+	}
+	if c.conf.ConsolePort == 0 {
+		return nil
+	}
+
+	c.server = new(network.TCPServer)
+	c.server.Addr = "localhost:" + strconv.Itoa(c.conf.ConsolePort)
+	c.server.MaxConnNum = int(math.MaxInt32)
+	c.server.PendingWriteNum = 100
+	c.server.NewAgent = c.newAgent
+	c.server.Logger = c.logger
+
+	err := c.server.Listen()
+	if err != nil {
+		c.server = nil
+		return err
+	}
+
+	return nil
+}
+
+func (c *Console) Destroy() {
+	if c.server != nil {
+		c.server.Close()
 	}
 }
 
 type Agent struct {
-	conn   *network.TCPConn
-	reader *bufio.Reader
+	console *Console
+	conn    *network.TCPConn
+	reader  *bufio.Reader
 }
 
-func newAgent(conn *network.TCPConn) network.Agent {
+func (c *Console) newAgent(conn *network.TCPConn) network.Agent {
 	a := new(Agent)
+	a.console = c
 	a.conn = conn
 	a.reader = bufio.NewReader(conn)
 	return a
 }
 
 func (a *Agent) Run() {
+	prompt := a.console.conf.ConsolePrompt
 	for {
-		if conf.ConsolePrompt != "" {
-			a.conn.Write([]byte(conf.ConsolePrompt))
+		if prompt != "" {
+			a.conn.Write([]byte(prompt))
 		}
 
 		line, err := a.reader.ReadString('\n')
@@ -63,7 +121,7 @@ func (a *Agent) Run() {
 			break
 		}
 		var c Command
-		for _, _c := range commands {
+		for _, _c := range a.console.commands {
 			if _c.name() == args[0] {
 				c = _c
 				break
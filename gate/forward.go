@@ -0,0 +1,431 @@
+package gate
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/cluster"
+	"github.com/name5566/leaf/network"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// cluster message addresses
+const (
+	forwardAddr = "leaf.gate.forward"
+	pushAddr    = "leaf.gate.push"
+)
+
+// kinds
+const (
+	kindOpen = iota + 1
+	kindData
+	kindClose
+)
+
+// -------------------------------
+// | kind | session id | payload |
+// -------------------------------
+// session id is an 8-byte big-endian integer
+//
+// open payload:
+// ---------------------------------------------------------------
+// | len(local addr) | local addr | len(remote addr) | remote addr |
+// ---------------------------------------------------------------
+// len is a 1-byte integer
+//
+// data payload:
+// ----------------
+// | message data |
+// ----------------
+//
+// close has no payload
+
+var (
+	lastSessionID uint64
+
+	// cluster -> the gates forwarding through it, a push is handled by the
+	// gate of the session
+	pushGates      = make(map[*cluster.Cluster][]*Gate)
+	mutexPushGates sync.RWMutex
+)
+
+func addPushGate(c *cluster.Cluster, gate *Gate) {
+	mutexPushGates.Lock()
+	defer mutexPushGates.Unlock()
+	if _, ok := pushGates[c]; !ok {
+		c.SetHandler(pushAddr, func(_ *cluster.Agent, msg []byte) {
+			handlePush(c, msg)
+		})
+	}
+	pushGates[c] = append(pushGates[c], gate)
+}
+
+// the push handler of the cluster is kept
+func removePushGate(c *cluster.Cluster, gate *Gate) {
+	mutexPushGates.Lock()
+	defer mutexPushGates.Unlock()
+	gates := pushGates[c]
+	for i, g := range gates {
+		if g == gate {
+			pushGates[c] = append(gates[:i:i], gates[i+1:]...)
+			return
+		}
+	}
+}
+
+func pushAgent(c *cluster.Cluster, sessionID uint64) *agent {
+	mutexPushGates.RLock()
+	gates := pushGates[c]
+	mutexPushGates.RUnlock()
+
+	for _, gate := range gates {
+		gate.mutexAgents.RLock()
+		a := gate.agents[sessionID]
+		gate.mutexAgents.RUnlock()
+		if a != nil {
+			return a
+		}
+	}
+	return nil
+}
+
+func newSessionID() uint64 {
+	return atomic.AddUint64(&lastSessionID, 1)
+}
+
+func pack(kind byte, sessionID uint64, payload ...[]byte) []byte {
+	l := 9
+	for _, p := range payload {
+		l += len(p)
+	}
+
+	msg := make([]byte, 9, l)
+	msg[0] = kind
+	binary.BigEndian.PutUint64(msg[1:], sessionID)
+	for _, p := range payload {
+		msg = append(msg, p...)
+	}
+	return msg
+}
+
+func unpack(msg []byte) (byte, uint64, []byte, error) {
+	if len(msg) < 9 {
+		return 0, 0, nil, errors.New("invalid forward message")
+	}
+
+	return msg[0], binary.BigEndian.Uint64(msg[1:]), msg[9:], nil
+}
+
+func packAddr(addr net.Addr) []byte {
+	var s string
+	if addr != nil {
+		s = addr.String()
+	}
+	if len(s) > 255 {
+		s = s[:255]
+	}
+
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func unpackAddr(b []byte) (netAddr, []byte, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return "", nil, errors.New("invalid address")
+	}
+
+	return netAddr(b[1 : 1+b[0]]), b[1+b[0]:], nil
+}
+
+type netAddr string
+
+func (addr netAddr) Network() string {
+	return "tcp"
+}
+
+func (addr netAddr) String() string {
+	return string(addr)
+}
+
+// gate: send a client message to the backend node, the session is opened
+// on every new link to the node (e.g. after the node reconnects) before its
+// messages are sent on the link
+func (a *agent) forward(node string, data []byte) error {
+	link := a.gate.cluster().GetAgent(node)
+	if link == nil {
+		return fmt.Errorf("node %v not connected", node)
+	}
+
+	a.mutexBackends.Lock()
+	opened := a.backends[node] == link
+	a.mutexBackends.Unlock()
+	if !opened {
+		err := link.WriteMsg(forwardAddr, pack(kindOpen, a.sessionID,
+			packAddr(a.LocalAddr()), packAddr(a.RemoteAddr())))
+		if err != nil {
+			return err
+		}
+		a.mutexBackends.Lock()
+		if a.backends != nil {
+			a.backends[node] = link
+		}
+		a.mutexBackends.Unlock()
+	}
+
+	return link.WriteMsg(forwardAddr, pack(kindData, a.sessionID, data))
+}
+
+// gate: tell the backend nodes that the client is gone
+func (a *agent) closeBackends() {
+	a.mutexBackends.Lock()
+	backends := a.backends
+	a.backends = nil
+	a.mutexBackends.Unlock()
+
+	c := a.gate.cluster()
+	for node := range backends {
+		c.Send(node, forwardAddr, pack(kindClose, a.sessionID))
+	}
+}
+
+func (gate *Gate) cluster() *cluster.Cluster {
+	if gate.Cluster != nil {
+		return gate.Cluster
+	}
+	return cluster.Default()
+}
+
+// gate: a backend node writes to or closes a client
+func handlePush(c *cluster.Cluster, msg []byte) {
+	kind, sessionID, data, err := unpack(msg)
+	if err != nil {
+		c.Logger().Error("%v", err)
+		return
+	}
+
+	a := pushAgent(c, sessionID)
+	if a == nil {
+		return
+	}
+
+	switch kind {
+	case kindData:
+		err = a.writeMsg(data)
+		if err != nil {
+			c.Logger().Error("write message error: %v", err)
+		}
+	case kindClose:
+		a.Close()
+	}
+}
+
+// Backend receives the messages forwarded by gates
+// a client appears as an Agent and the same chanrpc (NewAgent and
+// CloseAgent) is used as by Gate
+type Backend struct {
+	Processor    network.Processor
+	AgentChanRPC *chanrpc.Server
+	// the cluster of leaf.Run if nil
+	Cluster     *cluster.Cluster
+	server      *chanrpc.Server
+	agents      map[backendKey]*backendAgent
+	mutexAgents sync.Mutex
+}
+
+type backendKey struct {
+	node      string
+	sessionID uint64
+}
+
+// you must call the function before calling cluster.Init
+func (b *Backend) Init() {
+	if b.Cluster == nil {
+		b.Cluster = cluster.Default()
+	}
+	b.agents = make(map[backendKey]*backendAgent)
+	b.Cluster.SetHandler(forwardAddr, b.handleForward)
+
+	// close the sessions of a disconnected gate
+	s := chanrpc.NewServer(0)
+	s.Register("NodeDown", func(args []interface{}) {
+		b.closeNode(args[0].(cluster.NodeInfo).Name)
+	})
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+	b.Cluster.Subscribe(s)
+	b.server = s
+}
+
+// the sessions are kept, e.g. called when the module is destroyed
+func (b *Backend) Close() {
+	if b.server != nil {
+		b.server.Close()
+		b.server = nil
+	}
+}
+
+// goroutine safe
+func (b *Backend) GetAgent(node string, sessionID uint64) Agent {
+	b.mutexAgents.Lock()
+	defer b.mutexAgents.Unlock()
+
+	if a, ok := b.agents[backendKey{node, sessionID}]; ok {
+		return a
+	}
+	return nil
+}
+
+func (b *Backend) handleForward(ca *cluster.Agent, msg []byte) {
+	kind, sessionID, payload, err := unpack(msg)
+	if err != nil {
+		b.Cluster.Logger().Error("%v", err)
+		return
+	}
+	key := backendKey{ca.Name(), sessionID}
+
+	switch kind {
+	case kindOpen:
+		localAddr, payload, err := unpackAddr(payload)
+		if err != nil {
+			b.Cluster.Logger().Error("%v", err)
+			return
+		}
+		remoteAddr, _, err := unpackAddr(payload)
+		if err != nil {
+			b.Cluster.Logger().Error("%v", err)
+			return
+		}
+
+		a := &backendAgent{
+			node:       ca.Name(),
+			link:       ca,
+			sessionID:  sessionID,
+			localAddr:  localAddr,
+			remoteAddr: remoteAddr,
+			backend:    b,
+		}
+		// the session of a previous link
+		b.mutexAgents.Lock()
+		old := b.agents[key]
+		b.agents[key] = a
+		b.mutexAgents.Unlock()
+
+		if b.AgentChanRPC != nil {
+			if old != nil {
+				b.AgentChanRPC.Go("CloseAgent", old)
+			}
+			b.AgentChanRPC.Go("NewAgent", a)
+		}
+	case kindData:
+		b.mutexAgents.Lock()
+		a := b.agents[key]
+		b.mutexAgents.Unlock()
+		if a == nil || a.link != ca || b.Processor == nil {
+			b.Cluster.Logger().Debug("session %v of node %v not opened", sessionID, ca.Name())
+			return
+		}
+
+		m, err := b.Processor.Unmarshal(payload)
+		if err != nil {
+			b.Cluster.Logger().Debug("unmarshal message error: %v", err)
+			a.Close()
+			return
+		}
+		err = b.Processor.Route(m, a)
+		if err != nil {
+			b.Cluster.Logger().Debug("route message error: %v", err)
+			a.Close()
+		}
+	case kindClose:
+		b.mutexAgents.Lock()
+		a := b.agents[key]
+		delete(b.agents, key)
+		b.mutexAgents.Unlock()
+
+		if a != nil && b.AgentChanRPC != nil {
+			b.AgentChanRPC.Go("CloseAgent", a)
+		}
+	}
+}
+
+// the sessions opened on a new link to the node are kept
+func (b *Backend) closeNode(node string) {
+	var agents []*backendAgent
+
+	b.mutexAgents.Lock()
+	link := b.Cluster.GetAgent(node)
+	for key, a := range b.agents {
+		if key.node == node && a.link != link {
+			agents = append(agents, a)
+			delete(b.agents, key)
+		}
+	}
+	b.mutexAgents.Unlock()
+
+	if b.AgentChanRPC != nil {
+		for _, a := range agents {
+			b.AgentChanRPC.Go("CloseAgent", a)
+		}
+	}
+}
+
+type backendAgent struct {
+	node string
+	// the link the session is opened on
+	link       *cluster.Agent
+	sessionID  uint64
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	backend    *Backend
+	userData   interface{}
+}
+
+func (a *backendAgent) WriteMsg(msg interface{}) {
+	if a.backend.Processor == nil {
+		return
+	}
+
+	data, err := a.backend.Processor.Marshal(msg)
+	if err != nil {
+		a.backend.Cluster.Logger().Error("marshal message %v error: %v", reflect.TypeOf(msg), err)
+		return
+	}
+	err = a.backend.Cluster.Send(a.node, pushAddr, pack(kindData, a.sessionID, data...))
+	if err != nil {
+		a.backend.Cluster.Logger().Error("write message %v error: %v", reflect.TypeOf(msg), err)
+	}
+}
+
+func (a *backendAgent) LocalAddr() net.Addr {
+	return a.localAddr
+}
+
+func (a *backendAgent) RemoteAddr() net.Addr {
+	return a.remoteAddr
+}
+
+func (a *backendAgent) Close() {
+	a.backend.Cluster.Send(a.node, pushAddr, pack(kindClose, a.sessionID))
+}
+
+func (a *backendAgent) Destroy() {
+	a.Close()
+}
+
+func (a *backendAgent) UserData() interface{} {
+	return a.userData
+}
+
+func (a *backendAgent) SetUserData(data interface{}) {
+	a.userData = data
+}
+
+func (a *backendAgent) SessionID() uint64 {
+	return a.sessionID
+}
@@ -0,0 +1,113 @@
+package gate
+
+import (
+	"github.com/name5566/leaf/cluster"
+	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/network/json"
+	"testing"
+	"time"
+)
+
+func newNode(c *conf.Config) *cluster.Cluster {
+	c.ConnectInterval = 20 * time.Millisecond
+	c.PendingWriteNum = 100
+	return cluster.New(c)
+}
+
+// a gate on the node g forwarding every message to the backend on the node b
+func startForwarding(t *testing.T) (*Gate, *cluster.Cluster, *Backend, *recorder) {
+	gate := &Gate{Forward: func(a Agent, data []byte) string {
+		return "b"
+	}}
+	addr := freeAddr(t)
+	gate.Cluster = newNode(&conf.Config{NodeName: "g", ListenAddr: addr})
+	startGate(t, gate)
+
+	p := json.NewProcessor()
+	p.Register(&Hello{})
+	p.Register(&Chat{})
+	r := newRecorder()
+	t.Cleanup(r.server.Close)
+	p.SetRouter(&Hello{}, r.server)
+	p.SetRouter(&Chat{}, r.server)
+	b := newNode(&conf.Config{NodeName: "b", ListenAddr: freeAddr(t), ConnAddrs: []string{addr}})
+	backend := &Backend{Processor: p, AgentChanRPC: r.server, Cluster: b}
+	backend.Init()
+
+	// the nodes are destroyed before the gate and the servers
+	t.Cleanup(func() {
+		b.Destroy()
+		gate.Cluster.Destroy()
+		backend.Close()
+	})
+	for _, n := range []*cluster.Cluster{gate.Cluster, b} {
+		err := n.Init()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.wait(t, "the link", func() bool {
+		return gate.Cluster.GetAgent("b") != nil && b.GetAgent("g") != nil
+	})
+	return gate, b, backend, r
+}
+
+func TestForward(t *testing.T) {
+	gate, b, backend, r := startForwarding(t)
+
+	// open
+	conn := dial(t, gate)
+	writeMsg(t, conn, []byte(`{"Hello":{"N":1}}`))
+	r.wait(t, "NewAgent", func() bool {
+		return len(r.agents) == 1 && len(r.routed) == 1
+	})
+	r.mutex.Lock()
+	a := r.agents[0]
+	hello := r.routed[0].(*Hello)
+	r.mutex.Unlock()
+	if hello.N != 1 {
+		t.Fatalf("routed %+v", hello)
+	}
+	if backend.GetAgent("g", a.SessionID()) != a {
+		t.Fatal("the session is not found by its id")
+	}
+
+	// push
+	a.WriteMsg(&Chat{Text: "hi"})
+	if msg := readMsg(conn, time.Second); string(msg) != `{"Chat":{"Text":"hi"}}` {
+		t.Fatalf("pushed %q", msg)
+	}
+
+	// the session is opened again on the new link before its message
+	link := gate.Cluster.GetAgent("b")
+	b.GetAgent("g").Close()
+	r.wait(t, "the new link", func() bool {
+		l := gate.Cluster.GetAgent("b")
+		return l != nil && l != link
+	})
+	writeMsg(t, conn, []byte(`{"Hello":{"N":2}}`))
+	r.wait(t, "the reopened session", func() bool {
+		return len(r.agents) == 2 && len(r.routed) == 2 && r.closed == 1
+	})
+	r.mutex.Lock()
+	a = r.agents[1]
+	hello = r.routed[1].(*Hello)
+	r.mutex.Unlock()
+	if hello.N != 2 {
+		t.Fatalf("routed %+v", hello)
+	}
+	// NodeDown of the previous link
+	time.Sleep(50 * time.Millisecond)
+	if backend.GetAgent("g", a.SessionID()) != a {
+		t.Fatal("the reopened session is closed")
+	}
+
+	// close
+	conn.Close()
+	r.wait(t, "CloseAgent", func() bool {
+		return r.closed == 2
+	})
+	if backend.GetAgent("g", a.SessionID()) != nil {
+		t.Fatal("the session is not closed")
+	}
+}
@@ -1,11 +1,19 @@
 package gate
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/cluster"
+	"github.com/name5566/leaf/conf"
 	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/module"
 	"github.com/name5566/leaf/network"
 	"net"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,6 +24,46 @@ type Gate struct {
 	Processor       network.Processor
 	AgentChanRPC    *chanrpc.Server
 
+	// forward mode
+	// returns the backend node the message is forwarded to or "" to route
+	// the message by Processor
+	Forward func(a Agent, data []byte) string
+	// the cluster of the App (see SetEnv) or of leaf.Run if nil
+	Cluster *cluster.Cluster
+
+	// sent to the clients when the server is shutting down
+	ShutdownMsg interface{}
+
+	// the connection is closed if no message is received in ReadIdleTimeout
+	// or a write blocks for WriteIdleTimeout, no timeout if 0
+	ReadIdleTimeout  time.Duration
+	WriteIdleTimeout time.Duration
+
+	// heartbeat, e.g. ReadIdleTimeout is a few heartbeat intervals
+	// HeartbeatMsg is answered with HeartbeatAck (no answer if nil) by the
+	// gate, it is neither routed nor forwarded
+	HeartbeatMsg interface{}
+	HeartbeatAck interface{}
+
+	// rate limiting of the client messages, no limit if nil
+	// a violation is reported to AgentChanRPC by LimitExceeded with the
+	// agent, the message (nil if not unmarshaled yet) and the action
+	Limit *Limit
+	// message type -> limit, in addition to Limit
+	MsgLimits map[reflect.Type]*Limit
+	// returns the limits of a reloaded config, they replace Limit and
+	// MsgLimits on the gate goroutine (see SetLimits)
+	ReloadLimits func(c *conf.Config) (*Limit, map[reflect.Type]*Limit)
+	// the reloader of the App or of leaf.Run if nil
+	Reloader *conf.Reloader
+
+	// resumable sessions, see resume.go for the protocol, disabled if 0
+	// a disconnected session is kept for ResumeGrace, CloseAgent is called
+	// when the client does not resume in time
+	ResumeGrace time.Duration
+	// the unacknowledged messages kept for replay
+	ResumeBufferLen int
+
 	// websocket
 	WSAddr      string
 	HTTPTimeout time.Duration
@@ -26,25 +74,132 @@ type Gate struct {
 	TCPAddr      string
 	LenMsgLen    int
 	LittleEndian bool
+
+	logger *log.Logger
+
+	// receives ConfigReload, handled on the gate goroutine
+	server *chanrpc.Server
+	limits atomic.Value
+
+	heartbeatType reflect.Type
+	heartbeatData []byte
+	heartbeatAck  [][]byte
+
+	wsServer    *network.WSServer
+	tcpServer   *network.TCPServer
+	started     bool
+	mutexServer sync.Mutex
+	agents      map[uint64]*agent
+	users       map[interface{}]*agent
+	tokens      map[string]*agent
+	mutexAgents sync.RWMutex
+	groups      map[string]*Group
+	mutexGroups sync.Mutex
 }
 
-func (gate *Gate) Run(closeSig chan bool) {
+// sets Cluster and Reloader if nil and the fields of the gate settings of
+// the config (WSAddr, MaxConnNum...) if zero, called by the module manager
+func (gate *Gate) SetEnv(env *module.Env) {
+	if gate.Cluster == nil {
+		gate.Cluster = env.Cluster
+	}
+	if gate.Reloader == nil {
+		gate.Reloader = env.Reloader
+	}
+	gate.logger = env.Logger
+	if env.Conf != nil {
+		gate.setDefaults(env.Conf)
+	}
+}
+
+func (gate *Gate) setDefaults(c *conf.Config) {
+	if gate.WSAddr == "" {
+		gate.WSAddr = c.WSAddr
+	}
+	if gate.TCPAddr == "" {
+		gate.TCPAddr = c.TCPAddr
+	}
+	if gate.MaxConnNum == 0 {
+		gate.MaxConnNum = c.MaxConnNum
+	}
+	if gate.PendingWriteNum == 0 {
+		gate.PendingWriteNum = c.GatePendingWriteNum
+	}
+	if gate.MaxMsgLen == 0 {
+		gate.MaxMsgLen = c.MaxMsgLen
+	}
+	if gate.HTTPTimeout == 0 {
+		gate.HTTPTimeout = c.HTTPTimeout
+	}
+	if gate.CertFile == "" {
+		gate.CertFile = c.CertFile
+	}
+	if gate.KeyFile == "" {
+		gate.KeyFile = c.KeyFile
+	}
+	if gate.LenMsgLen == 0 {
+		gate.LenMsgLen = c.LenMsgLen
+	}
+	if !gate.LittleEndian {
+		gate.LittleEndian = c.LittleEndian
+	}
+	if gate.ReadIdleTimeout == 0 {
+		gate.ReadIdleTimeout = c.ReadIdleTimeout
+	}
+	if gate.WriteIdleTimeout == 0 {
+		gate.WriteIdleTimeout = c.WriteIdleTimeout
+	}
+}
+
+// listens before the modules run, called by Run if not called yet
+func (gate *Gate) OnStart() error {
+	gate.mutexServer.Lock()
+	defer gate.mutexServer.Unlock()
+	if gate.started {
+		return nil
+	}
+
+	err := gate.SetLimits(gate.Limit, gate.MsgLimits)
+	if err != nil {
+		return err
+	}
+	err = gate.initHeartbeat()
+	if err != nil {
+		return err
+	}
+	if gate.ResumeGrace > 0 && gate.ResumeBufferLen <= 0 {
+		gate.ResumeBufferLen = 100
+		gate.logger.Release("invalid ResumeBufferLen, reset to %v", gate.ResumeBufferLen)
+	}
+
+	if gate.Forward != nil {
+		addPushGate(gate.cluster(), gate)
+	}
+	gate.server = chanrpc.NewServer(0)
+	gate.server.Register("ConfigReload", func(args []interface{}) {
+		gate.onConfigReload(args[0].(*conf.Config), args[1].(*conf.Config))
+	})
+	r := gate.Reloader
+	if r == nil {
+		r = conf.DefaultReloader()
+	}
+	r.Subscribe(gate.server)
+
 	var wsServer *network.WSServer
 	if gate.WSAddr != "" {
 		wsServer = new(network.WSServer)
 		wsServer.Addr = gate.WSAddr
 		wsServer.MaxConnNum = gate.MaxConnNum
+		wsServer.Logger = gate.logger
 		wsServer.PendingWriteNum = gate.PendingWriteNum
 		wsServer.MaxMsgLen = gate.MaxMsgLen
 		wsServer.HTTPTimeout = gate.HTTPTimeout
+		wsServer.ReadIdleTimeout = gate.ReadIdleTimeout
+		wsServer.WriteIdleTimeout = gate.WriteIdleTimeout
 		wsServer.CertFile = gate.CertFile
 		wsServer.KeyFile = gate.KeyFile
 		wsServer.NewAgent = func(conn *network.WSConn) network.Agent {
-			a := &agent{conn: conn, gate: gate}
-			if gate.AgentChanRPC != nil {
-				gate.AgentChanRPC.Go("NewAgent", a)
-			}
-			return a
+			return gate.newAgent(conn)
 		}
 	}
 
@@ -53,101 +208,363 @@ func (gate *Gate) Run(closeSig chan bool) {
 		tcpServer = new(network.TCPServer)
 		tcpServer.Addr = gate.TCPAddr
 		tcpServer.MaxConnNum = gate.MaxConnNum
+		tcpServer.Logger = gate.logger
 		tcpServer.PendingWriteNum = gate.PendingWriteNum
+		tcpServer.ReadIdleTimeout = gate.ReadIdleTimeout
+		tcpServer.WriteIdleTimeout = gate.WriteIdleTimeout
 		tcpServer.LenMsgLen = gate.LenMsgLen
 		tcpServer.MaxMsgLen = gate.MaxMsgLen
 		tcpServer.LittleEndian = gate.LittleEndian
 		tcpServer.NewAgent = func(conn *network.TCPConn) network.Agent {
-			a := &agent{conn: conn, gate: gate}
-			if gate.AgentChanRPC != nil {
-				gate.AgentChanRPC.Go("NewAgent", a)
-			}
-			return a
+			return gate.newAgent(conn)
 		}
 	}
 
 	if wsServer != nil {
-		wsServer.Start()
+		err = wsServer.Listen()
+		if err != nil {
+			return err
+		}
 	}
 	if tcpServer != nil {
-		tcpServer.Start()
+		err = tcpServer.Listen()
+		if err != nil {
+			if wsServer != nil {
+				wsServer.Close()
+			}
+			return err
+		}
+	}
+	gate.wsServer = wsServer
+	gate.tcpServer = tcpServer
+	gate.started = true
+
+	return nil
+}
+
+func (gate *Gate) initHeartbeat() error {
+	if gate.HeartbeatMsg == nil {
+		return nil
+	}
+	if gate.Processor == nil {
+		return errors.New("HeartbeatMsg requires Processor")
+	}
+
+	data, err := gate.Processor.Marshal(gate.HeartbeatMsg)
+	if err != nil {
+		return fmt.Errorf("marshal message %v error: %v", reflect.TypeOf(gate.HeartbeatMsg), err)
+	}
+	gate.heartbeatType = reflect.TypeOf(gate.HeartbeatMsg)
+	gate.heartbeatData = bytes.Join(data, nil)
+
+	if gate.HeartbeatAck != nil {
+		gate.heartbeatAck, err = gate.Processor.Marshal(gate.HeartbeatAck)
+		if err != nil {
+			return fmt.Errorf("marshal message %v error: %v", reflect.TypeOf(gate.HeartbeatAck), err)
+		}
+	}
+	return nil
+}
+
+func (gate *Gate) Run(closeSig chan bool) {
+	err := gate.OnStart()
+	if err != nil {
+		gate.logger.Fatal("%v", err)
+	}
+
+	gate.mutexServer.Lock()
+	server := gate.server
+	gate.mutexServer.Unlock()
+
+	var chanCall chan *chanrpc.CallInfo
+	if server != nil {
+		chanCall = server.ChanCall
+	}
+	for {
+		select {
+		case <-closeSig:
+			gate.closeServers()
+			return
+		case ci := <-chanCall:
+			server.Exec(ci)
+		}
+	}
+}
+
+// MaxConnNum is set if modified in the config, the limits are reloaded by
+// ReloadLimits
+func (gate *Gate) onConfigReload(c *conf.Config, old *conf.Config) {
+	if c.MaxConnNum != old.MaxConnNum && c.MaxConnNum > 0 {
+		gate.SetMaxConnNum(c.MaxConnNum)
+	}
+	if gate.ReloadLimits != nil {
+		gate.reloadLimits(c)
 	}
-	<-closeSig
+}
+
+// the established connections are kept, e.g. called when the config is
+// reloaded
+// goroutine safe
+func (gate *Gate) SetMaxConnNum(n int) {
+	gate.mutexServer.Lock()
+	defer gate.mutexServer.Unlock()
+
+	gate.MaxConnNum = n
+	if gate.wsServer != nil {
+		gate.wsServer.SetMaxConnNum(n)
+	}
+	if gate.tcpServer != nil {
+		gate.tcpServer.SetMaxConnNum(n)
+	}
+}
+
+// closes the servers if the gate does not run
+func (gate *Gate) OnDestroy() {
+	gate.closeServers()
+}
+
+func (gate *Gate) closeServers() {
+	gate.mutexServer.Lock()
+	wsServer := gate.wsServer
+	tcpServer := gate.tcpServer
+	server := gate.server
+	gate.wsServer = nil
+	gate.tcpServer = nil
+	gate.server = nil
+	gate.mutexServer.Unlock()
+
 	if wsServer != nil {
 		wsServer.Close()
 	}
 	if tcpServer != nil {
 		tcpServer.Close()
 	}
+	gate.endSessions()
+	if server != nil {
+		server.Close()
+	}
+	if gate.Forward != nil {
+		removePushGate(gate.cluster(), gate)
+	}
 }
 
-func (gate *Gate) OnDestroy() {}
+// stops accepting clients and sends ShutdownMsg to the clients
+func (gate *Gate) OnDrain() {
+	gate.mutexServer.Lock()
+	wsServer := gate.wsServer
+	tcpServer := gate.tcpServer
+	gate.mutexServer.Unlock()
+
+	if wsServer != nil {
+		wsServer.CloseListener()
+	}
+	if tcpServer != nil {
+		tcpServer.CloseListener()
+	}
+
+	if gate.ShutdownMsg == nil || gate.Processor == nil {
+		return
+	}
+	data, err := gate.Processor.Marshal(gate.ShutdownMsg)
+	if err != nil {
+		gate.logger.Error("marshal message %v error: %v", reflect.TypeOf(gate.ShutdownMsg), err)
+		return
+	}
+
+	for _, a := range gate.agentList() {
+		a.writeMsg(data...)
+	}
+}
+
+func (gate *Gate) newAgent(conn network.Conn) network.Agent {
+	if gate.ResumeGrace > 0 {
+		return newLink(gate, conn)
+	}
+	return gate.openAgent(conn, nil)
+}
+
+// l is the connection of a resumable session, nil if not resumable
+func (gate *Gate) openAgent(conn network.Conn, l *link) *agent {
+	a := &agent{conn: conn, gate: gate}
+	a.sessionID = newSessionID()
+	a.backends = make(map[string]*cluster.Agent)
+	a.groups = make(map[*Group]struct{})
+	if l != nil {
+		a.open(l)
+	}
+	gate.addAgent(a)
+	if gate.AgentChanRPC != nil {
+		gate.AgentChanRPC.Go("NewAgent", a)
+	}
+	return a
+}
 
 type agent struct {
-	conn     network.Conn
-	gate     *Gate
-	userData interface{}
+	conn      network.Conn // replaced on resume
+	gate      *Gate
+	userData  interface{}
+	sessionID uint64
+	userID    interface{}
+	// nil once closed
+	// node -> the link the session is opened on
+	backends      map[string]*cluster.Agent
+	mutexBackends sync.Mutex
+	// used by Run only
+	limiter     limiter
+	msgLimiters map[reflect.Type]*limiter
+	// nil once closed
+	groups      map[*Group]struct{}
+	mutexGroups sync.Mutex
+
+	// resumable session, see resume.go
+	token     string
+	link      *link
+	connected bool
+	closing   bool
+	ended     bool
+	seq       uint64
+	unacked   [][][]byte
+	timer     *time.Timer
+	mutexConn sync.Mutex
 }
 
 func (a *agent) Run() {
 	for {
 		data, err := a.conn.ReadMsg()
 		if err != nil {
-			log.Debug("read message: %v", err)
+			a.gate.logger.Debug("read message: %v", err)
+			break
+		}
+		if !a.handle(data) {
 			break
 		}
+	}
+}
 
-		if a.gate.Processor != nil {
-			msg, err := a.gate.Processor.Unmarshal(data)
-			if err != nil {
-				log.Debug("unmarshal message error: %v", err)
-				break
-			}
-			err = a.gate.Processor.Route(msg, a)
+// returns false if the connection must be closed
+func (a *agent) handle(data []byte) bool {
+	limits := a.gate.getLimits()
+	if limits.limit != nil {
+		ok, err := a.limit(limits.limit, &a.limiter, nil, len(data))
+		if err != nil {
+			a.gate.logger.Debug("%v", err)
+			return false
+		}
+		if !ok {
+			return true
+		}
+	}
+
+	// the same encoding as the gate, compared before unmarshaling
+	if a.gate.heartbeatData != nil && bytes.Equal(data, a.gate.heartbeatData) {
+		a.heartbeat()
+		return true
+	}
+
+	if a.gate.Forward != nil {
+		if node := a.gate.Forward(a, data); node != "" {
+			err := a.forward(node, data)
 			if err != nil {
-				log.Debug("route message error: %v", err)
-				break
+				a.gate.logger.Debug("forward message error: %v", err)
+				return false
 			}
+			return true
 		}
 	}
+
+	if a.gate.Processor != nil {
+		msg, err := a.gate.Processor.Unmarshal(data)
+		if err != nil {
+			a.gate.logger.Debug("unmarshal message error: %v", err)
+			return false
+		}
+		if a.gate.heartbeatType != nil && reflect.TypeOf(msg) == a.gate.heartbeatType {
+			a.heartbeat()
+			return true
+		}
+		ok, err := a.limitMsg(limits.msgLimits, msg, len(data))
+		if err != nil {
+			a.gate.logger.Debug("%v", err)
+			return false
+		}
+		if !ok {
+			return true
+		}
+		err = a.gate.Processor.Route(msg, a)
+		if err != nil {
+			a.gate.logger.Debug("route message error: %v", err)
+			return false
+		}
+	}
+	return true
+}
+
+func (a *agent) heartbeat() {
+	if a.gate.heartbeatAck == nil {
+		return
+	}
+
+	err := a.writeMsg(a.gate.heartbeatAck...)
+	if err != nil {
+		a.gate.logger.Error("write heartbeat error: %v", err)
+	}
 }
 
 func (a *agent) OnClose() {
+	a.end()
+}
+
+func (a *agent) end() {
+	a.closeBackends()
+
 	if a.gate.AgentChanRPC != nil {
 		err := a.gate.AgentChanRPC.Call0("CloseAgent", a)
 		if err != nil {
-			log.Error("chanrpc error: %v", err)
+			a.gate.logger.Error("chanrpc error: %v", err)
 		}
 	}
+
+	// the user id is still bound and the groups are still joined in
+	// CloseAgent
+	a.gate.removeAgent(a)
+	a.leaveGroups()
 }
 
 func (a *agent) WriteMsg(msg interface{}) {
 	if a.gate.Processor != nil {
 		data, err := a.gate.Processor.Marshal(msg)
 		if err != nil {
-			log.Error("marshal message %v error: %v", reflect.TypeOf(msg), err)
+			a.gate.logger.Error("marshal message %v error: %v", reflect.TypeOf(msg), err)
 			return
 		}
-		err = a.conn.WriteMsg(data...)
+		err = a.writeMsg(data...)
 		if err != nil {
-			log.Error("write message %v error: %v", reflect.TypeOf(msg), err)
+			a.gate.logger.Error("write message %v error: %v", reflect.TypeOf(msg), err)
 		}
 	}
 }
 
 func (a *agent) LocalAddr() net.Addr {
-	return a.conn.LocalAddr()
+	return a.getConn().LocalAddr()
 }
 
 func (a *agent) RemoteAddr() net.Addr {
-	return a.conn.RemoteAddr()
+	return a.getConn().RemoteAddr()
 }
 
 func (a *agent) Close() {
+	if a.token != "" {
+		a.closeSession(false)
+		return
+	}
 	a.conn.Close()
 }
 
 func (a *agent) Destroy() {
+	if a.token != "" {
+		a.closeSession(true)
+		return
+	}
 	a.conn.Destroy()
 }
 
@@ -158,3 +575,7 @@ func (a *agent) UserData() interface{} {
 func (a *agent) SetUserData(data interface{}) {
 	a.userData = data
 }
+
+func (a *agent) SessionID() uint64 {
+	return a.sessionID
+}
@@ -0,0 +1,244 @@
+package gate
+
+import (
+	"encoding/binary"
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/cluster"
+	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/module"
+	"github.com/name5566/leaf/network/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type Hello struct {
+	N int
+}
+
+type Chat struct {
+	Text string
+}
+
+// the calls of the agent chanrpc server of a test gate
+type recorder struct {
+	server *chanrpc.Server
+	mutex  sync.Mutex
+	agents []Agent
+	routed []interface{}
+	closed int
+	// the arguments of LimitExceeded
+	reports [][]interface{}
+}
+
+func newRecorder() *recorder {
+	r := new(recorder)
+	r.server = chanrpc.NewServer(100)
+	r.server.Register("NewAgent", func(args []interface{}) {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.agents = append(r.agents, args[0].(Agent))
+	})
+	r.server.Register("CloseAgent", func(args []interface{}) {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.closed++
+	})
+	r.server.Register("LimitExceeded", func(args []interface{}) {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.reports = append(r.reports, args)
+	})
+	route := func(args []interface{}) {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.routed = append(r.routed, args[0])
+	}
+	r.server.Register(reflect.TypeOf(&Hello{}), route)
+	r.server.Register(reflect.TypeOf(&Chat{}), route)
+
+	go func() {
+		for ci := range r.server.ChanCall {
+			r.server.Exec(ci)
+		}
+	}()
+	return r
+}
+
+func (r *recorder) state() (agents int, routed int, closed int, reports int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.agents), len(r.routed), r.closed, len(r.reports)
+}
+
+// waits until f returns true
+func (r *recorder) wait(t *testing.T, what string, f func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		r.mutex.Lock()
+		ok := f()
+		r.mutex.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %v", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// a gate on a loopback address routing Hello and Chat to the recorder
+func startGate(t *testing.T, gate *Gate) *recorder {
+	p := json.NewProcessor()
+	p.Register(&Hello{})
+	p.Register(&Chat{})
+	r := newRecorder()
+	p.SetRouter(&Hello{}, r.server)
+	p.SetRouter(&Chat{}, r.server)
+
+	gate.TCPAddr = freeAddr(t)
+	gate.MaxConnNum = 10
+	gate.PendingWriteNum = 100
+	gate.MaxMsgLen = 4096
+	gate.LenMsgLen = 2
+	gate.Processor = p
+	gate.AgentChanRPC = r.server
+	err := gate.OnStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		gate.OnDestroy()
+		r.server.Close()
+	})
+	return r
+}
+
+func dial(t *testing.T, gate *Gate) net.Conn {
+	conn, err := net.Dial("tcp", gate.TCPAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn
+}
+
+func writeMsg(t *testing.T, conn net.Conn, data ...[]byte) {
+	var msg []byte
+	for _, d := range data {
+		msg = append(msg, d...)
+	}
+	b := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	_, err := conn.Write(append(b, msg...))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// returns nil on timeout or error
+func readMsg(conn net.Conn, timeout time.Duration) []byte {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	b := make([]byte, 2)
+	_, err := io.ReadFull(conn, b)
+	if err != nil {
+		return nil
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(b))
+	_, err = io.ReadFull(conn, msg)
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+func TestSetEnv(t *testing.T) {
+	c := conf.New()
+	c.WSAddr = "127.0.0.1:3653"
+	c.TCPAddr = "127.0.0.1:3563"
+	c.MaxConnNum = 20
+	c.GatePendingWriteNum = 50
+	c.MaxMsgLen = 1024
+	c.LenMsgLen = 4
+	c.LittleEndian = true
+	c.ReadIdleTimeout = time.Minute
+	env := &module.Env{Conf: c, Cluster: cluster.New(c), Reloader: conf.NewReloader(c)}
+
+	// the fields set are kept
+	gate := &Gate{TCPAddr: "127.0.0.1:0", MaxMsgLen: 4096, WriteIdleTimeout: time.Second}
+	gate.SetEnv(env)
+	if gate.Cluster != env.Cluster || gate.Reloader != env.Reloader {
+		t.Fatal("the cluster and the reloader are not set")
+	}
+	got := []interface{}{gate.WSAddr, gate.TCPAddr, gate.MaxConnNum, gate.PendingWriteNum, gate.MaxMsgLen,
+		gate.LenMsgLen, gate.LittleEndian, gate.ReadIdleTimeout, gate.WriteIdleTimeout}
+	want := []interface{}{c.WSAddr, "127.0.0.1:0", 20, 50, uint32(4096),
+		4, true, time.Minute, time.Second}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestReloadMaxConnNum(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "leaf.json")
+	err := ioutil.WriteFile(filename, []byte(`{"gate": {"max_conn_num": 1}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := conf.New()
+	c.ConfigFile = filename
+	r := conf.NewReloader(c)
+
+	gate := &Gate{Reloader: r}
+	rec := startGate(t, gate)
+	closeSig := make(chan bool, 1)
+	done := make(chan struct{})
+	go func() {
+		gate.Run(closeSig)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		closeSig <- true
+		<-done
+	})
+
+	// applied on the gate goroutine
+	err = r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.wait(t, "MaxConnNum", func() bool {
+		gate.mutexServer.Lock()
+		defer gate.mutexServer.Unlock()
+		return gate.MaxConnNum == 1
+	})
+
+	// the second connection is closed
+	conn := dial(t, gate)
+	writeMsg(t, conn, []byte(`{"Hello":{}}`))
+	rec.wait(t, "NewAgent", func() bool {
+		return len(rec.agents) == 1
+	})
+	conn2 := dial(t, gate)
+	if _, err := conn2.Read(make([]byte, 1)); err == nil {
+		t.Fatal("too many connections")
+	}
+}
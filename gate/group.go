@@ -0,0 +1,168 @@
+package gate
+
+import (
+	"errors"
+	"sync"
+)
+
+// a named set of agents of a gate, e.g. a room, a guild or the world chat
+// an agent leaves its groups when closed
+// goroutine safe
+type Group struct {
+	name         string
+	gate         *Gate
+	members      map[uint64]*agent
+	mutexMembers sync.RWMutex
+}
+
+// returns the group, created if not found
+// goroutine safe
+func (gate *Gate) Group(name string) *Group {
+	gate.mutexGroups.Lock()
+	defer gate.mutexGroups.Unlock()
+
+	if gate.groups == nil {
+		gate.groups = make(map[string]*Group)
+	}
+	g := gate.groups[name]
+	if g == nil {
+		g = &Group{name: name, gate: gate, members: make(map[uint64]*agent)}
+		gate.groups[name] = g
+	}
+	return g
+}
+
+// goroutine safe
+func (gate *Gate) GetGroup(name string) *Group {
+	gate.mutexGroups.Lock()
+	defer gate.mutexGroups.Unlock()
+	return gate.groups[name]
+}
+
+// the members leave the group
+// goroutine safe
+func (gate *Gate) RemoveGroup(name string) {
+	gate.mutexGroups.Lock()
+	g := gate.groups[name]
+	delete(gate.groups, name)
+	gate.mutexGroups.Unlock()
+
+	if g != nil {
+		g.Clear()
+	}
+}
+
+func (g *Group) Name() string {
+	return g.name
+}
+
+// a must be an agent of the gate
+func (g *Group) Join(a Agent) error {
+	ga, ok := a.(*agent)
+	if !ok || ga.gate != g.gate {
+		return errors.New("not an agent of the gate")
+	}
+
+	g.mutexMembers.Lock()
+	defer g.mutexMembers.Unlock()
+
+	ga.mutexGroups.Lock()
+	defer ga.mutexGroups.Unlock()
+	if ga.groups == nil {
+		return errors.New("agent closed")
+	}
+	ga.groups[g] = struct{}{}
+	g.members[ga.sessionID] = ga
+	return nil
+}
+
+func (g *Group) Leave(a Agent) {
+	ga, ok := a.(*agent)
+	if !ok {
+		return
+	}
+
+	g.mutexMembers.Lock()
+	defer g.mutexMembers.Unlock()
+	g.leave(ga)
+}
+
+func (g *Group) leave(a *agent) {
+	if g.members[a.sessionID] != a {
+		return
+	}
+	delete(g.members, a.sessionID)
+
+	a.mutexGroups.Lock()
+	delete(a.groups, g)
+	a.mutexGroups.Unlock()
+}
+
+// all the members leave the group
+func (g *Group) Clear() {
+	g.mutexMembers.Lock()
+	defer g.mutexMembers.Unlock()
+	for _, a := range g.members {
+		g.leave(a)
+	}
+}
+
+func (g *Group) Has(a Agent) bool {
+	g.mutexMembers.RLock()
+	defer g.mutexMembers.RUnlock()
+	return a != nil && g.members[a.SessionID()] == a
+}
+
+func (g *Group) Len() int {
+	g.mutexMembers.RLock()
+	defer g.mutexMembers.RUnlock()
+	return len(g.members)
+}
+
+// f must not block
+func (g *Group) Range(f func(a Agent) bool) {
+	for _, a := range g.memberList(nil) {
+		if !f(a) {
+			return
+		}
+	}
+}
+
+func (g *Group) memberList(except Agent) []*agent {
+	g.mutexMembers.RLock()
+	defer g.mutexMembers.RUnlock()
+
+	agents := make([]*agent, 0, len(g.members))
+	for _, a := range g.members {
+		if Agent(a) != except {
+			agents = append(agents, a)
+		}
+	}
+	return agents
+}
+
+// msg is marshaled once and the same bytes are written to every member
+func (g *Group) Broadcast(msg interface{}) {
+	g.gate.broadcast(g.memberList(nil), msg)
+}
+
+// e.g. a chat message not echoed to its sender
+func (g *Group) BroadcastExcept(msg interface{}, except Agent) {
+	g.gate.broadcast(g.memberList(except), msg)
+}
+
+// the agent leaves its groups
+func (a *agent) leaveGroups() {
+	a.mutexGroups.Lock()
+	groups := a.groups
+	a.groups = nil
+	a.mutexGroups.Unlock()
+
+	for g := range groups {
+		g.mutexMembers.Lock()
+		if g.members[a.sessionID] == a {
+			delete(g.members, a.sessionID)
+		}
+		g.mutexMembers.Unlock()
+	}
+}
@@ -0,0 +1,207 @@
+package gate
+
+import (
+	"errors"
+	"fmt"
+	"github.com/name5566/leaf/conf"
+	"reflect"
+	"time"
+)
+
+// actions taken when a client exceeds a limit
+const (
+	// drop the message
+	LimitDrop = iota
+	// stop reading from the client until the message is allowed
+	LimitDelay
+	// close the connection
+	LimitDisconnect
+)
+
+// token buckets, a client may send MsgBurst messages and ByteBurst bytes at
+// once and MsgRate messages and ByteRate bytes per second on average
+type Limit struct {
+	// no limit if 0
+	MsgRate  float64
+	ByteRate float64
+	// one second of rate if 0
+	// a message longer than ByteBurst always exceeds the limit
+	MsgBurst  int
+	ByteBurst int
+	Action    int
+}
+
+func (l *Limit) check() error {
+	if l.MsgRate < 0 || l.ByteRate < 0 || l.MsgBurst < 0 || l.ByteBurst < 0 {
+		return errors.New("must not be negative")
+	}
+	if l.Action < LimitDrop || l.Action > LimitDisconnect {
+		return fmt.Errorf("invalid action %v", l.Action)
+	}
+	return nil
+}
+
+// the limits in use, replaced as a whole
+type limits struct {
+	limit     *Limit
+	msgLimits map[reflect.Type]*Limit
+}
+
+func (ls *limits) check() error {
+	if ls.limit != nil {
+		err := ls.limit.check()
+		if err != nil {
+			return fmt.Errorf("limit: %v", err)
+		}
+	}
+	for t, l := range ls.msgLimits {
+		err := l.check()
+		if err != nil {
+			return fmt.Errorf("limit of %v: %v", t, err)
+		}
+	}
+	return nil
+}
+
+// replaces the limits of a running gate, the limits must not be modified
+// afterwards, the tokens of the clients are kept
+// goroutine safe
+func (gate *Gate) SetLimits(limit *Limit, msgLimits map[reflect.Type]*Limit) error {
+	ls := &limits{limit: limit, msgLimits: msgLimits}
+	err := ls.check()
+	if err != nil {
+		return err
+	}
+
+	gate.limits.Store(ls)
+	return nil
+}
+
+func (gate *Gate) getLimits() *limits {
+	if ls, ok := gate.limits.Load().(*limits); ok {
+		return ls
+	}
+	return new(limits)
+}
+
+// the current limits are kept if the new ones are invalid
+func (gate *Gate) reloadLimits(c *conf.Config) {
+	err := gate.SetLimits(gate.ReloadLimits(c))
+	if err != nil {
+		gate.logger.Error("reload limits error: %v", err)
+	}
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(rate float64, burst int, now time.Time) {
+	max := float64(burst)
+	if max <= 0 {
+		max = rate
+	}
+	if max < 1 {
+		max = 1
+	}
+	if b.last.IsZero() {
+		b.tokens = max
+	} else {
+		b.tokens += rate * now.Sub(b.last).Seconds()
+		if b.tokens > max {
+			b.tokens = max
+		}
+	}
+	b.last = now
+}
+
+// returns how long to wait until n tokens are available
+func (b *bucket) wait(rate float64, n float64) time.Duration {
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / rate * float64(time.Second))
+}
+
+// the state of a limit for an agent
+type limiter struct {
+	msgs       bucket
+	bytes      bucket
+	lastReport time.Time
+}
+
+// returns how long to wait until the message is allowed
+// the tokens are taken if allowed or if the action is LimitDelay
+func (lim *limiter) take(l *Limit, n int, now time.Time) time.Duration {
+	var wait time.Duration
+	if l.MsgRate > 0 {
+		lim.msgs.refill(l.MsgRate, l.MsgBurst, now)
+		wait = lim.msgs.wait(l.MsgRate, 1)
+	}
+	if l.ByteRate > 0 {
+		lim.bytes.refill(l.ByteRate, l.ByteBurst, now)
+		if w := lim.bytes.wait(l.ByteRate, float64(n)); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 && l.Action != LimitDelay {
+		return wait
+	}
+
+	if l.MsgRate > 0 {
+		lim.msgs.tokens--
+	}
+	if l.ByteRate > 0 {
+		lim.bytes.tokens -= float64(n)
+	}
+	return wait
+}
+
+// returns false if the message is dropped and an error if the client is
+// disconnected
+// msg is nil before the message is unmarshaled
+func (a *agent) limit(l *Limit, lim *limiter, msg interface{}, n int) (bool, error) {
+	now := time.Now()
+	wait := lim.take(l, n, now)
+	if wait <= 0 {
+		return true, nil
+	}
+
+	// reported once a second at most
+	if a.gate.AgentChanRPC != nil && now.Sub(lim.lastReport) >= time.Second {
+		lim.lastReport = now
+		a.gate.AgentChanRPC.Go("LimitExceeded", a, msg, l.Action)
+	}
+
+	switch l.Action {
+	case LimitDelay:
+		time.Sleep(wait)
+		return true, nil
+	case LimitDisconnect:
+		if msg != nil {
+			return false, fmt.Errorf("message %v: limit exceeded", reflect.TypeOf(msg))
+		}
+		return false, errors.New("limit exceeded")
+	default:
+		return false, nil
+	}
+}
+
+func (a *agent) limitMsg(msgLimits map[reflect.Type]*Limit, msg interface{}, n int) (bool, error) {
+	t := reflect.TypeOf(msg)
+	l := msgLimits[t]
+	if l == nil {
+		return true, nil
+	}
+
+	if a.msgLimiters == nil {
+		a.msgLimiters = make(map[reflect.Type]*limiter)
+	}
+	lim := a.msgLimiters[t]
+	if lim == nil {
+		lim = new(limiter)
+		a.msgLimiters[t] = lim
+	}
+	return a.limit(l, lim, msg, n)
+}
@@ -0,0 +1,169 @@
+package gate
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLimiterTake(t *testing.T) {
+	type step struct {
+		at   time.Duration
+		n    int
+		wait time.Duration
+	}
+	tests := []struct {
+		name  string
+		limit Limit
+		steps []step
+	}{
+		{"burst", Limit{MsgRate: 10, MsgBurst: 3}, []step{
+			{0, 1, 0}, {0, 1, 0}, {0, 1, 0}, {0, 1, 100 * time.Millisecond},
+		}},
+		{"refill", Limit{MsgRate: 10, MsgBurst: 2}, []step{
+			{0, 1, 0}, {0, 1, 0}, {0, 1, 100 * time.Millisecond},
+			{150 * time.Millisecond, 1, 0}, {150 * time.Millisecond, 1, 50 * time.Millisecond},
+			// no more than the burst
+			{10 * time.Second, 1, 0}, {10 * time.Second, 1, 0}, {10 * time.Second, 1, 100 * time.Millisecond},
+		}},
+		{"burst of one second", Limit{MsgRate: 2}, []step{
+			{0, 1, 0}, {0, 1, 0}, {0, 1, 500 * time.Millisecond},
+		}},
+		{"burst of at least one", Limit{MsgRate: 0.5}, []step{
+			{0, 1, 0}, {0, 1, 2 * time.Second}, {2 * time.Second, 1, 0},
+		}},
+		{"bytes", Limit{ByteRate: 100, ByteBurst: 10}, []step{
+			{0, 8, 0}, {0, 8, 60 * time.Millisecond}, {60 * time.Millisecond, 8, 0},
+		}},
+		{"longer than the burst", Limit{ByteRate: 100, ByteBurst: 10}, []step{
+			{0, 11, 10 * time.Millisecond}, {time.Minute, 11, 10 * time.Millisecond},
+		}},
+		{"messages and bytes", Limit{MsgRate: 10, MsgBurst: 5, ByteRate: 100, ByteBurst: 10}, []step{
+			{0, 10, 0}, {0, 1, 10 * time.Millisecond},
+		}},
+		// the tokens are taken while waiting
+		{"delay", Limit{MsgRate: 10, MsgBurst: 1, Action: LimitDelay}, []step{
+			{0, 1, 0}, {0, 1, 100 * time.Millisecond}, {0, 1, 200 * time.Millisecond},
+		}},
+		{"no limit", Limit{}, []step{
+			{0, 1000, 0}, {0, 1000, 0},
+		}},
+	}
+
+	start := time.Now()
+	for _, test := range tests {
+		var lim limiter
+		for i, s := range test.steps {
+			wait := lim.take(&test.limit, s.n, start.Add(s.at))
+			if d := wait - s.wait; d < -time.Microsecond || d > time.Microsecond {
+				t.Errorf("%v: step %v: wait %v, want %v", test.name, i, wait, s.wait)
+			}
+		}
+	}
+}
+
+func TestLimitCheck(t *testing.T) {
+	tests := []struct {
+		limit Limit
+		ok    bool
+	}{
+		{Limit{MsgRate: 10, MsgBurst: 5, Action: LimitDisconnect}, true},
+		{Limit{MsgRate: -1}, false},
+		{Limit{ByteBurst: -1}, false},
+		{Limit{Action: LimitDisconnect + 1}, false},
+	}
+
+	for _, test := range tests {
+		gate := new(Gate)
+		err := gate.SetLimits(&test.limit, nil)
+		if (err == nil) != test.ok {
+			t.Errorf("%+v: got %v", test.limit, err)
+		}
+		err = gate.SetLimits(nil, map[reflect.Type]*Limit{reflect.TypeOf(&Chat{}): &test.limit})
+		if (err == nil) != test.ok {
+			t.Errorf("%+v of *Chat: got %v", test.limit, err)
+		}
+	}
+}
+
+func TestLimitAction(t *testing.T) {
+	hello := []byte(`{"Hello":{}}`)
+	chat := []byte(`{"Chat":{}}`)
+	tests := []struct {
+		name      string
+		limit     *Limit
+		msgLimits map[reflect.Type]*Limit
+		msgs      [][]byte
+		routed    int
+		closed    bool
+		// the message of LimitExceeded
+		report interface{}
+	}{
+		{"drop", &Limit{MsgRate: 1, MsgBurst: 5}, nil,
+			repeat(hello, 20), 5, false, nil},
+		{"delay", &Limit{MsgRate: 100, MsgBurst: 5, Action: LimitDelay}, nil,
+			repeat(hello, 20), 20, false, nil},
+		{"disconnect", &Limit{ByteRate: 1, ByteBurst: 3 * len(hello), Action: LimitDisconnect}, nil,
+			repeat(hello, 20), 3, true, nil},
+		{"message type", nil, map[reflect.Type]*Limit{reflect.TypeOf(&Chat{}): {MsgRate: 1, MsgBurst: 2}},
+			append(repeat(hello, 5), repeat(chat, 5)...), 7, false, &Chat{}},
+		{"message type disconnect", nil, map[reflect.Type]*Limit{reflect.TypeOf(&Chat{}): {MsgRate: 1, MsgBurst: 2, Action: LimitDisconnect}},
+			append(repeat(chat, 5), repeat(hello, 5)...), 2, true, &Chat{}},
+	}
+
+	for _, test := range tests {
+		gate := &Gate{Limit: test.limit, MsgLimits: test.msgLimits}
+		r := startGate(t, gate)
+		conn := dial(t, gate)
+
+		start := time.Now()
+		for _, msg := range test.msgs {
+			writeMsg(t, conn, msg)
+		}
+		r.wait(t, test.name, func() bool {
+			return len(r.routed) >= test.routed && len(r.reports) > 0 && (!test.closed || r.closed > 0)
+		})
+		// nothing else arrives
+		time.Sleep(50 * time.Millisecond)
+
+		_, routed, closed, reports := r.state()
+		if routed != test.routed {
+			t.Errorf("%v: %v routed, want %v", test.name, routed, test.routed)
+		}
+		if (closed > 0) != test.closed {
+			t.Errorf("%v: closed %v, want %v", test.name, closed > 0, test.closed)
+		}
+		// reported once a second at most
+		if reports != 1 {
+			t.Fatalf("%v: %v reports, want 1", test.name, reports)
+		}
+		r.mutex.Lock()
+		report := r.reports[0]
+		a := r.agents[0]
+		r.mutex.Unlock()
+		if reflect.TypeOf(report[1]) != reflect.TypeOf(test.report) {
+			t.Errorf("%v: reported %T, want %T", test.name, report[1], test.report)
+		}
+		if report[0] != a {
+			t.Errorf("%v: reported agent %v", test.name, report[0])
+		}
+		l := test.limit
+		if l == nil {
+			l = test.msgLimits[reflect.TypeOf(&Chat{})]
+		}
+		if report[2] != l.Action {
+			t.Errorf("%v: reported action %v, want %v", test.name, report[2], l.Action)
+		}
+		if l.Action == LimitDelay && time.Since(start) < 100*time.Millisecond {
+			t.Errorf("%v: not delayed", test.name)
+		}
+	}
+}
+
+func repeat(msg []byte, n int) [][]byte {
+	msgs := make([][]byte, n)
+	for i := range msgs {
+		msgs[i] = msg
+	}
+	return msgs
+}
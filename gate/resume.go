@@ -0,0 +1,363 @@
+package gate
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/name5566/leaf/network"
+	"time"
+)
+
+// frames of the resumable sessions
+const (
+	frameSession = iota + 1
+	frameData
+	frameAck
+	frameResume
+)
+
+// every message is a frame if ResumeGrace is set
+// ----------------------
+// | kind | payload     |
+// ----------------------
+// seq is an 8-byte big-endian integer, the first message of a session is 1
+// token is 16 bytes
+// the frame header counts against MaxMsgLen
+//
+// gate to client:
+// session payload: | token |
+// sent first on every connection, the token is unchanged if the session is
+// resumed, otherwise the session is new
+// data payload: | seq | message data |
+//
+// client to gate:
+// data payload: | message data |
+// ack payload: | seq |
+// the messages up to seq are received and need not be kept
+// resume payload: | token | seq |
+// the first message of a connection to resume a session, seq is the last
+// message received, the messages after seq are sent again
+// a connection beginning with a data message opens a new session
+
+const tokenLen = 16
+
+// a connection of a resumable session
+type link struct {
+	gate  *Gate
+	conn  network.Conn
+	agent *agent
+	done  chan struct{}
+}
+
+func newLink(gate *Gate, conn network.Conn) *link {
+	return &link{gate: gate, conn: conn, done: make(chan struct{})}
+}
+
+func (l *link) Run() {
+	defer close(l.done)
+
+	data, err := l.conn.ReadMsg()
+	if err != nil {
+		l.gate.logger.Debug("read message: %v", err)
+		return
+	}
+	if len(data) < 1 {
+		l.gate.logger.Debug("invalid frame")
+		return
+	}
+
+	switch data[0] {
+	case frameResume:
+		if len(data) != 1+tokenLen+8 {
+			l.gate.logger.Debug("invalid resume frame")
+			return
+		}
+		token := string(data[1 : 1+tokenLen])
+		seq := binary.BigEndian.Uint64(data[1+tokenLen:])
+
+		l.gate.mutexAgents.RLock()
+		a := l.gate.tokens[token]
+		l.gate.mutexAgents.RUnlock()
+
+		if a != nil && a.attach(l, seq) {
+			l.agent = a
+		} else {
+			// the client starts over
+			if a != nil {
+				a.Close()
+			}
+			l.gate.logger.Debug("resume session failed")
+			l.agent = l.gate.openAgent(l.conn, l)
+		}
+		data = nil
+	case frameData:
+		l.agent = l.gate.openAgent(l.conn, l)
+		data = data[1:]
+	default:
+		l.gate.logger.Debug("invalid frame kind %v", data[0])
+		return
+	}
+
+	a := l.agent
+	for {
+		if data != nil && !a.handle(data) {
+			a.Close()
+			return
+		}
+
+		data, err = l.conn.ReadMsg()
+		if err != nil {
+			l.gate.logger.Debug("read message: %v", err)
+			return
+		}
+		if len(data) < 1 {
+			l.gate.logger.Debug("invalid frame")
+			a.Close()
+			return
+		}
+
+		switch data[0] {
+		case frameData:
+			data = data[1:]
+		case frameAck:
+			if len(data) != 1+8 {
+				l.gate.logger.Debug("invalid ack frame")
+				a.Close()
+				return
+			}
+			a.ack(binary.BigEndian.Uint64(data[1:]))
+			data = nil
+		default:
+			l.gate.logger.Debug("invalid frame kind %v", data[0])
+			a.Close()
+			return
+		}
+	}
+}
+
+// the session is kept for ResumeGrace unless closed by the server
+func (l *link) OnClose() {
+	a := l.agent
+	if a == nil {
+		return
+	}
+
+	a.mutexConn.Lock()
+	if a.link != l {
+		a.mutexConn.Unlock()
+		return
+	}
+	a.link = nil
+	a.connected = false
+	if a.closing && !a.ended {
+		a.ended = true
+		a.mutexConn.Unlock()
+		a.end()
+		return
+	}
+	if !a.ended {
+		a.timer = time.AfterFunc(a.gate.ResumeGrace, a.expire)
+	}
+	a.mutexConn.Unlock()
+}
+
+func newToken() string {
+	b := make([]byte, tokenLen)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// a new session of l
+func (a *agent) open(l *link) {
+	a.token = newToken()
+	a.link = l
+	a.connected = true
+
+	err := a.conn.WriteMsg([]byte{frameSession}, []byte(a.token))
+	if err != nil {
+		a.gate.logger.Error("write session error: %v", err)
+	}
+}
+
+// returns false if the session cannot be resumed
+func (a *agent) attach(l *link, seq uint64) bool {
+	a.mutexConn.Lock()
+	if a.ended || a.closing || !a.replayable(seq) {
+		a.mutexConn.Unlock()
+		return false
+	}
+	old := a.link
+	a.link = l
+	a.connected = false
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	a.mutexConn.Unlock()
+
+	// the messages of the old connection are handled before the new ones
+	if old != nil {
+		old.conn.Destroy()
+		<-old.done
+	}
+
+	a.mutexConn.Lock()
+	defer a.mutexConn.Unlock()
+	if a.link != l {
+		return false
+	}
+	if a.ended || a.closing || !a.replayable(seq) {
+		// the session is given up
+		a.link = nil
+		if !a.ended {
+			a.ended = true
+			go a.end()
+		}
+		return false
+	}
+
+	a.drop(seq)
+	a.conn = l.conn
+	a.connected = true
+	err := a.conn.WriteMsg([]byte{frameSession}, []byte(a.token))
+	if err != nil {
+		a.gate.logger.Error("write session error: %v", err)
+	}
+	for _, msg := range a.unacked {
+		err = a.conn.WriteMsg(msg...)
+		if err != nil {
+			a.gate.logger.Error("write message error: %v", err)
+		}
+	}
+	return true
+}
+
+func (a *agent) replayable(seq uint64) bool {
+	first := a.seq + 1 - uint64(len(a.unacked))
+	return seq+1 >= first && seq <= a.seq
+}
+
+// the messages up to seq are received
+func (a *agent) ack(seq uint64) {
+	a.mutexConn.Lock()
+	defer a.mutexConn.Unlock()
+	a.drop(seq)
+}
+
+func (a *agent) drop(seq uint64) {
+	first := a.seq + 1 - uint64(len(a.unacked))
+	if seq < first {
+		return
+	}
+	n := seq - first + 1
+	if n > uint64(len(a.unacked)) {
+		n = uint64(len(a.unacked))
+	}
+	a.unacked = a.unacked[n:]
+}
+
+func (a *agent) expire() {
+	a.mutexConn.Lock()
+	if a.link != nil || a.ended {
+		a.mutexConn.Unlock()
+		return
+	}
+	a.ended = true
+	a.mutexConn.Unlock()
+
+	a.gate.logger.Debug("session %v expired", a.sessionID)
+	a.end()
+}
+
+// ends a resumable session
+func (a *agent) closeSession(destroy bool) {
+	a.mutexConn.Lock()
+	if a.ended || a.closing {
+		a.mutexConn.Unlock()
+		return
+	}
+	a.closing = true
+
+	// the link ends the session
+	if a.link != nil {
+		conn := a.link.conn
+		a.mutexConn.Unlock()
+		if destroy {
+			conn.Destroy()
+		} else {
+			conn.Close()
+		}
+		return
+	}
+
+	a.ended = true
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	a.mutexConn.Unlock()
+
+	// not on the caller goroutine, CloseAgent may be handled by the caller
+	go a.end()
+}
+
+// ends the sessions kept for resuming, the connections must be closed
+func (gate *Gate) endSessions() {
+	for _, a := range gate.agentList() {
+		if a.token == "" {
+			continue
+		}
+
+		a.mutexConn.Lock()
+		if a.ended || a.link != nil {
+			a.mutexConn.Unlock()
+			continue
+		}
+		a.ended = true
+		if a.timer != nil {
+			a.timer.Stop()
+			a.timer = nil
+		}
+		a.mutexConn.Unlock()
+
+		a.end()
+	}
+}
+
+func (a *agent) getConn() network.Conn {
+	a.mutexConn.Lock()
+	defer a.mutexConn.Unlock()
+	return a.conn
+}
+
+// the messages of a resumable session are numbered and kept until
+// acknowledged
+func (a *agent) writeMsg(args ...[]byte) error {
+	if a.token == "" {
+		return a.conn.WriteMsg(args...)
+	}
+
+	a.mutexConn.Lock()
+	defer a.mutexConn.Unlock()
+	if a.ended || a.closing {
+		return nil
+	}
+
+	a.seq++
+	header := make([]byte, 9)
+	header[0] = frameData
+	binary.BigEndian.PutUint64(header[1:], a.seq)
+	msg := append([][]byte{header}, args...)
+
+	a.unacked = append(a.unacked, msg)
+	if len(a.unacked) > a.gate.ResumeBufferLen {
+		a.unacked = a.unacked[1:]
+	}
+
+	if !a.connected {
+		return nil
+	}
+	return a.conn.WriteMsg(msg...)
+}
@@ -0,0 +1,183 @@
+package gate
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func readFrame(t *testing.T, conn net.Conn) (byte, []byte) {
+	t.Helper()
+	msg := readMsg(conn, time.Second)
+	if len(msg) < 1 {
+		t.Fatal("no frame")
+	}
+	return msg[0], msg[1:]
+}
+
+func readSession(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	kind, payload := readFrame(t, conn)
+	if kind != frameSession || len(payload) != tokenLen {
+		t.Fatalf("got frame %v %q, want a session frame", kind, payload)
+	}
+	return string(payload)
+}
+
+func readData(t *testing.T, conn net.Conn) (uint64, string) {
+	t.Helper()
+	kind, payload := readFrame(t, conn)
+	if kind != frameData || len(payload) < 8 {
+		t.Fatalf("got frame %v %q, want a data frame", kind, payload)
+	}
+	return binary.BigEndian.Uint64(payload), string(payload[8:])
+}
+
+func seqBytes(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
+func chat(n int) string {
+	return fmt.Sprintf(`{"Chat":{"Text":"%v"}}`, n)
+}
+
+// opens a session and returns its token and agent
+func openSession(t *testing.T, gate *Gate, r *recorder) (net.Conn, string, Agent) {
+	t.Helper()
+	agents, _, _, _ := r.state()
+	conn := dial(t, gate)
+	writeMsg(t, conn, []byte{frameData}, []byte(`{"Hello":{}}`))
+	token := readSession(t, conn)
+	r.wait(t, "NewAgent", func() bool {
+		return len(r.agents) > agents
+	})
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return conn, token, r.agents[len(r.agents)-1]
+}
+
+func TestResume(t *testing.T) {
+	gate := &Gate{ResumeGrace: time.Second, ResumeBufferLen: 10}
+	r := startGate(t, gate)
+	conn, token, a := openSession(t, gate, r)
+
+	// numbered from 1
+	for i := 1; i <= 3; i++ {
+		a.WriteMsg(&Chat{Text: fmt.Sprint(i)})
+	}
+	for i := 1; i <= 3; i++ {
+		seq, data := readData(t, conn)
+		if seq != uint64(i) || data != chat(i) {
+			t.Fatalf("got %v %v, want %v %v", seq, data, i, chat(i))
+		}
+	}
+
+	// 1 is dropped
+	writeMsg(t, conn, []byte{frameAck}, seqBytes(1))
+	r.wait(t, "ack", func() bool {
+		ga := a.(*agent)
+		ga.mutexConn.Lock()
+		defer ga.mutexConn.Unlock()
+		return len(ga.unacked) == 2
+	})
+
+	// kept while disconnected
+	conn.Close()
+	r.wait(t, "disconnection", func() bool {
+		ga := a.(*agent)
+		ga.mutexConn.Lock()
+		defer ga.mutexConn.Unlock()
+		return !ga.connected
+	})
+	a.WriteMsg(&Chat{Text: "4"})
+	a.WriteMsg(&Chat{Text: "5"})
+
+	// 2 was not received
+	conn = dial(t, gate)
+	writeMsg(t, conn, []byte{frameResume}, []byte(token), seqBytes(1))
+	if readSession(t, conn) != token {
+		t.Fatal("session not resumed")
+	}
+	for i := 2; i <= 5; i++ {
+		seq, data := readData(t, conn)
+		if seq != uint64(i) || data != chat(i) {
+			t.Fatalf("replay: got %v %v, want %v %v", seq, data, i, chat(i))
+		}
+	}
+
+	// the messages of the new connection are routed to the same agent
+	writeMsg(t, conn, []byte{frameData}, []byte(`{"Chat":{"Text":"hi"}}`))
+	r.wait(t, "route", func() bool {
+		return len(r.routed) == 2
+	})
+	agents, _, closed, _ := r.state()
+	if agents != 1 || closed != 0 {
+		t.Fatalf("%v agents, %v closed, want 1 and 0", agents, closed)
+	}
+	if gate.AgentNum() != 1 {
+		t.Fatalf("%v sessions, want 1", gate.AgentNum())
+	}
+}
+
+func TestResumeStaleSeq(t *testing.T) {
+	gate := &Gate{ResumeGrace: time.Second, ResumeBufferLen: 2}
+	r := startGate(t, gate)
+	conn, token, a := openSession(t, gate, r)
+
+	// 1 is no longer kept
+	for i := 1; i <= 3; i++ {
+		a.WriteMsg(&Chat{Text: fmt.Sprint(i)})
+	}
+	for i := 1; i <= 3; i++ {
+		readData(t, conn)
+	}
+	conn.Close()
+
+	conn = dial(t, gate)
+	writeMsg(t, conn, []byte{frameResume}, []byte(token), seqBytes(0))
+	if readSession(t, conn) == token {
+		t.Fatal("session resumed")
+	}
+
+	// the old session is closed and a new one is opened
+	// the session is removed after CloseAgent returns
+	r.wait(t, "CloseAgent", func() bool {
+		return r.closed == 1 && len(r.agents) == 2 && gate.AgentNum() == 1
+	})
+
+	// a seq not sent yet
+	conn2 := dial(t, gate)
+	writeMsg(t, conn2, []byte{frameData}, []byte(`{"Hello":{}}`))
+	token2 := readSession(t, conn2)
+	conn3 := dial(t, gate)
+	writeMsg(t, conn3, []byte{frameResume}, []byte(token2), seqBytes(5))
+	if readSession(t, conn3) == token2 {
+		t.Fatal("session resumed")
+	}
+}
+
+func TestResumeGraceExpiry(t *testing.T) {
+	gate := &Gate{ResumeGrace: 100 * time.Millisecond, ResumeBufferLen: 10}
+	r := startGate(t, gate)
+	conn, token, _ := openSession(t, gate, r)
+
+	start := time.Now()
+	conn.Close()
+	r.wait(t, "CloseAgent", func() bool {
+		return r.closed == 1 && gate.AgentNum() == 0
+	})
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("closed after %v, want the grace period", d)
+	}
+
+	conn = dial(t, gate)
+	writeMsg(t, conn, []byte{frameResume}, []byte(token), seqBytes(0))
+	if readSession(t, conn) == token {
+		t.Fatal("expired session resumed")
+	}
+}
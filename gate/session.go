@@ -0,0 +1,230 @@
+package gate
+
+import (
+	"errors"
+	"reflect"
+)
+
+// the sessions of a gate, a session is an agent and its user id bound after
+// login
+
+func (gate *Gate) addAgent(a *agent) {
+	gate.mutexAgents.Lock()
+	defer gate.mutexAgents.Unlock()
+	if gate.agents == nil {
+		gate.agents = make(map[uint64]*agent)
+		gate.users = make(map[interface{}]*agent)
+		gate.tokens = make(map[string]*agent)
+	}
+	gate.agents[a.sessionID] = a
+	if a.token != "" {
+		gate.tokens[a.token] = a
+	}
+}
+
+func (gate *Gate) removeAgent(a *agent) {
+	gate.mutexAgents.Lock()
+	defer gate.mutexAgents.Unlock()
+	delete(gate.agents, a.sessionID)
+	delete(gate.tokens, a.token)
+	if a.userID != nil && gate.users[a.userID] == a {
+		delete(gate.users, a.userID)
+	}
+}
+
+// goroutine safe
+func (gate *Gate) GetAgent(sessionID uint64) Agent {
+	gate.mutexAgents.RLock()
+	defer gate.mutexAgents.RUnlock()
+	if a, ok := gate.agents[sessionID]; ok {
+		return a
+	}
+	return nil
+}
+
+// goroutine safe
+func (gate *Gate) GetUserAgent(userID interface{}) Agent {
+	gate.mutexAgents.RLock()
+	defer gate.mutexAgents.RUnlock()
+	if a, ok := gate.users[userID]; ok {
+		return a
+	}
+	return nil
+}
+
+// binds userID to the session, userID must be comparable
+// returns the agent userID was bound to, e.g. kick it on a second login
+// goroutine safe
+func (gate *Gate) Bind(sessionID uint64, userID interface{}) (Agent, error) {
+	if userID == nil {
+		return nil, errors.New("invalid user id")
+	}
+
+	gate.mutexAgents.Lock()
+	defer gate.mutexAgents.Unlock()
+
+	a := gate.agents[sessionID]
+	if a == nil {
+		return nil, errors.New("session not found")
+	}
+	if a.userID == userID {
+		return nil, nil
+	}
+	if a.userID != nil {
+		delete(gate.users, a.userID)
+	}
+
+	old := gate.users[userID]
+	if old != nil {
+		old.userID = nil
+	}
+	a.userID = userID
+	gate.users[userID] = a
+
+	if old != nil {
+		return old, nil
+	}
+	return nil, nil
+}
+
+// goroutine safe
+func (gate *Gate) Unbind(sessionID uint64) {
+	gate.mutexAgents.Lock()
+	defer gate.mutexAgents.Unlock()
+
+	a := gate.agents[sessionID]
+	if a == nil || a.userID == nil {
+		return
+	}
+	delete(gate.users, a.userID)
+	a.userID = nil
+}
+
+// returns nil if no user is bound to the session
+// goroutine safe
+func (gate *Gate) UserID(sessionID uint64) interface{} {
+	gate.mutexAgents.RLock()
+	defer gate.mutexAgents.RUnlock()
+	if a := gate.agents[sessionID]; a != nil {
+		return a.userID
+	}
+	return nil
+}
+
+// goroutine safe
+func (gate *Gate) AgentNum() int {
+	gate.mutexAgents.RLock()
+	defer gate.mutexAgents.RUnlock()
+	return len(gate.agents)
+}
+
+// goroutine safe
+func (gate *Gate) UserNum() int {
+	gate.mutexAgents.RLock()
+	defer gate.mutexAgents.RUnlock()
+	return len(gate.users)
+}
+
+// sends reason to the client if not nil and closes the connection after
+// the pending messages are written
+// goroutine safe
+func (gate *Gate) Kick(sessionID uint64, reason interface{}) bool {
+	gate.mutexAgents.RLock()
+	a := gate.agents[sessionID]
+	gate.mutexAgents.RUnlock()
+
+	return gate.kick(a, reason)
+}
+
+// goroutine safe
+func (gate *Gate) KickUser(userID interface{}, reason interface{}) bool {
+	gate.mutexAgents.RLock()
+	a := gate.users[userID]
+	gate.mutexAgents.RUnlock()
+
+	return gate.kick(a, reason)
+}
+
+func (gate *Gate) kick(a *agent, reason interface{}) bool {
+	if a == nil {
+		return false
+	}
+	if reason != nil {
+		a.WriteMsg(reason)
+	}
+	a.Close()
+	return true
+}
+
+// f must not block
+// goroutine safe
+func (gate *Gate) Range(f func(a Agent) bool) {
+	for _, a := range gate.agentList() {
+		if !f(a) {
+			return
+		}
+	}
+}
+
+func (gate *Gate) agentList() []*agent {
+	gate.mutexAgents.RLock()
+	defer gate.mutexAgents.RUnlock()
+
+	agents := make([]*agent, 0, len(gate.agents))
+	for _, a := range gate.agents {
+		agents = append(agents, a)
+	}
+	return agents
+}
+
+// msg is marshaled once for all the clients
+// goroutine safe
+func (gate *Gate) Broadcast(msg interface{}) {
+	gate.broadcast(gate.agentList(), msg)
+}
+
+// goroutine safe
+func (gate *Gate) BroadcastSessions(sessionIDs []uint64, msg interface{}) {
+	gate.mutexAgents.RLock()
+	agents := make([]*agent, 0, len(sessionIDs))
+	for _, id := range sessionIDs {
+		if a := gate.agents[id]; a != nil {
+			agents = append(agents, a)
+		}
+	}
+	gate.mutexAgents.RUnlock()
+
+	gate.broadcast(agents, msg)
+}
+
+// goroutine safe
+func (gate *Gate) BroadcastUsers(userIDs []interface{}, msg interface{}) {
+	gate.mutexAgents.RLock()
+	agents := make([]*agent, 0, len(userIDs))
+	for _, id := range userIDs {
+		if a := gate.users[id]; a != nil {
+			agents = append(agents, a)
+		}
+	}
+	gate.mutexAgents.RUnlock()
+
+	gate.broadcast(agents, msg)
+}
+
+func (gate *Gate) broadcast(agents []*agent, msg interface{}) {
+	if gate.Processor == nil || len(agents) == 0 {
+		return
+	}
+
+	data, err := gate.Processor.Marshal(msg)
+	if err != nil {
+		gate.logger.Error("marshal message %v error: %v", reflect.TypeOf(msg), err)
+		return
+	}
+	for _, a := range agents {
+		err = a.writeMsg(data...)
+		if err != nil {
+			gate.logger.Error("write message %v error: %v", reflect.TypeOf(msg), err)
+		}
+	}
+}
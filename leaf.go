@@ -4,43 +4,19 @@ import (
 	"github.com/name5566/leaf/cluster"
 	"github.com/name5566/leaf/conf"
 	"github.com/name5566/leaf/console"
-	"github.com/name5566/leaf/log"
 	"github.com/name5566/leaf/module"
-	"os"
-	"os/signal"
 )
 
 func Run(mods ...module.Module) {
-	// logger
-	if conf.LogLevel != "" {
-		logger, err := log.New(conf.LogLevel, conf.LogPath, conf.LogFlag)
-		if err != nil {
-			panic(err)
-		}
-		log.Export(logger)
-		defer logger.Close()
+	app := &App{
+		conf:     conf.Global(),
+		modules:  module.Default(),
+		cluster:  cluster.Default(),
+		console:  console.Default(),
+		reloader: conf.DefaultReloader(),
+		std:      true,
 	}
-
-	log.Release("Leaf %v starting up", version)
-
-	// module
-	for i := 0; i < len(mods); i++ {
-		module.Register(mods[i])
-	}
-	module.Init()
-
-	// cluster
-	cluster.Init()
-
-	// console
-	console.Init()
-
-	// close
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
-	sig := <-c
-	log.Release("Leaf closing down (signal: %v)", sig)
-	console.Destroy()
-	cluster.Destroy()
-	module.Destroy()
+	app.init()
+	app.Register(mods...)
+	app.Run()
 }
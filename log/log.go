@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,26 +26,34 @@ const (
 	printFatalLevel   = "[fatal  ] "
 )
 
+// the logging methods of a nil Logger use the logger of the package level
+// functions
 type Logger struct {
-	level      int
+	level      int32
 	baseLogger *log.Logger
 	baseFile   *os.File
 }
 
-func New(strLevel string, pathname string, flag int) (*Logger, error) {
-	// level
-	var level int
+func parseLevel(strLevel string) (int32, error) {
 	switch strings.ToLower(strLevel) {
 	case "debug":
-		level = debugLevel
+		return debugLevel, nil
 	case "release":
-		level = releaseLevel
+		return releaseLevel, nil
 	case "error":
-		level = errorLevel
+		return errorLevel, nil
 	case "fatal":
-		level = fatalLevel
+		return fatalLevel, nil
 	default:
-		return nil, errors.New("unknown level: " + strLevel)
+		return 0, errors.New("unknown level: " + strLevel)
+	}
+}
+
+func New(strLevel string, pathname string, flag int) (*Logger, error) {
+	// level
+	level, err := parseLevel(strLevel)
+	if err != nil {
+		return nil, err
 	}
 
 	// logger
@@ -91,8 +100,22 @@ func (logger *Logger) Close() {
 	logger.baseFile = nil
 }
 
-func (logger *Logger) doPrintf(level int, printLevel string, format string, a ...interface{}) {
-	if level < logger.level {
+// goroutine safe
+func (logger *Logger) SetLevel(strLevel string) error {
+	level, err := parseLevel(strLevel)
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&logger.level, level)
+	return nil
+}
+
+func (logger *Logger) doPrintf(level int32, printLevel string, format string, a ...interface{}) {
+	if logger == nil {
+		logger = gLogger
+	}
+	if level < atomic.LoadInt32(&logger.level) {
 		return
 	}
 	if logger.baseLogger == nil {
@@ -125,6 +148,11 @@ func (logger *Logger) Fatal(format string, a ...interface{}) {
 
 var gLogger, _ = New("debug", "", log.LstdFlags)
 
+// the logger used by the package level functions
+func Default() *Logger {
+	return gLogger
+}
+
 // It's dangerous to call the method on logging
 func Export(logger *Logger) {
 	if logger != nil {
@@ -0,0 +1,355 @@
+package module
+
+import (
+	"errors"
+	"fmt"
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/timer"
+	"time"
+)
+
+// an actor is a lightweight unit of a module with its own goroutine, mailbox
+// (a chanrpc server), timers and asynchronous calls
+// actors are spawned by a skeleton and addressed by id
+type Actor struct {
+	// set by the init function of Spawn
+	// Escalate if not set: the actor stops and the module Run panics
+	Policy    Policy
+	OnDestroy func()
+
+	id         interface{}
+	skeleton   *Skeleton
+	init       func(a *Actor)
+	server     *chanrpc.Server
+	client     *chanrpc.Client
+	dispatcher *timer.Dispatcher
+	closeSig   chan bool
+	restarts   int
+	failure    interface{}
+}
+
+// init registers the handlers and timers of the actor, it is called on the
+// calling goroutine and, on restart, again on the actor goroutine
+// goroutine safe
+func (s *Skeleton) Spawn(id interface{}, init func(a *Actor)) (*Actor, error) {
+	s.mutexActors.Lock()
+	if s.actorsClosed {
+		s.mutexActors.Unlock()
+		return nil, errors.New("skeleton closed")
+	}
+	if _, ok := s.actors[id]; ok {
+		s.mutexActors.Unlock()
+		return nil, fmt.Errorf("actor %v already exists", id)
+	}
+	// reserve the id, init may spawn other actors
+	s.actors[id] = nil
+	s.mutexActors.Unlock()
+
+	var a *Actor
+	defer func() {
+		s.mutexActors.Lock()
+		defer s.mutexActors.Unlock()
+		if a == nil || s.actorsClosed {
+			delete(s.actors, id)
+		}
+	}()
+
+	a = s.newActor(id, init, make(chan bool, 1), 0)
+
+	s.mutexActors.Lock()
+	if s.actorsClosed {
+		s.mutexActors.Unlock()
+		a.destroy()
+		return nil, errors.New("skeleton closed")
+	}
+	s.actors[id] = a
+	s.wgActors.Add(1)
+	s.mutexActors.Unlock()
+
+	go a.run()
+	return a, nil
+}
+
+// the actor may be replaced on restart, keep the id rather than the actor
+// goroutine safe
+func (s *Skeleton) Actor(id interface{}) *Actor {
+	s.mutexActors.RLock()
+	defer s.mutexActors.RUnlock()
+	return s.actors[id]
+}
+
+// goroutine safe
+func (s *Skeleton) ActorNum() int {
+	s.mutexActors.RLock()
+	defer s.mutexActors.RUnlock()
+	return len(s.actors)
+}
+
+func (s *Skeleton) newActor(id interface{}, init func(a *Actor), closeSig chan bool, restarts int) *Actor {
+	a := new(Actor)
+	a.id = id
+	a.skeleton = s
+	a.init = init
+	a.closeSig = closeSig
+	a.restarts = restarts
+	a.server = chanrpc.NewServer(s.ActorChanRPCLen)
+	a.server.Name = a.String()
+	a.server.Use(a.intercept)
+	a.client = chanrpc.NewClient(s.AsynCallLen)
+	a.dispatcher = timer.NewDispatcher(s.TimerDispatcherLen)
+	defer func() {
+		// the timers set before init panicked are not read
+		if r := recover(); r != nil {
+			a.dispatcher.Close()
+			panic(r)
+		}
+	}()
+	init(a)
+	return a
+}
+
+func (s *Skeleton) replaceActor(old *Actor, a *Actor) bool {
+	s.mutexActors.Lock()
+	defer s.mutexActors.Unlock()
+	if s.actors[old.id] != old {
+		return false
+	}
+	s.actors[old.id] = a
+	return true
+}
+
+func (s *Skeleton) removeActor(a *Actor) {
+	s.mutexActors.Lock()
+	defer s.mutexActors.Unlock()
+	if s.actors[a.id] == a {
+		delete(s.actors, a.id)
+	}
+}
+
+// the module Run panics with err
+func (s *Skeleton) escalateActor(err error) {
+	select {
+	case s.chanActorErr <- err:
+	default:
+	}
+}
+
+// returns a channel closed when all actors have stopped
+func (s *Skeleton) closeActors() chan struct{} {
+	s.mutexActors.Lock()
+	s.actorsClosed = true
+	for _, a := range s.actors {
+		if a != nil {
+			a.Stop()
+		}
+	}
+	s.mutexActors.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wgActors.Wait()
+		close(done)
+	}()
+	return done
+}
+
+func (a *Actor) ID() interface{} {
+	return a.id
+}
+
+func (a *Actor) String() string {
+	return fmt.Sprintf("%v/%v", a.skeleton.Name, a.id)
+}
+
+// the mailbox of the actor
+func (a *Actor) Server() *chanrpc.Server {
+	return a.server
+}
+
+// you must call the function in the init function of Spawn
+func (a *Actor) RegisterChanRPC(id interface{}, f interface{}) {
+	a.server.Register(id, f)
+}
+
+func (a *Actor) AfterFunc(d time.Duration, cb func()) *timer.Timer {
+	if a.skeleton.TimerDispatcherLen == 0 {
+		panic("invalid TimerDispatcherLen")
+	}
+
+	return a.dispatcher.AfterFunc(d, a.guard(cb))
+}
+
+func (a *Actor) CronFunc(cronExpr *timer.CronExpr, cb func()) *timer.Cron {
+	if a.skeleton.TimerDispatcherLen == 0 {
+		panic("invalid TimerDispatcherLen")
+	}
+
+	return a.dispatcher.CronFunc(cronExpr, a.guard(cb))
+}
+
+func (a *Actor) AsynCall(server *chanrpc.Server, id interface{}, args ...interface{}) {
+	if a.skeleton.AsynCallLen == 0 {
+		panic("invalid AsynCallLen")
+	}
+	if len(args) < 1 {
+		panic("callback function not found")
+	}
+
+	switch cb := args[len(args)-1].(type) {
+	case func(error):
+		args[len(args)-1] = func(err error) {
+			defer a.catch()
+			cb(err)
+		}
+	case func(interface{}, error):
+		args[len(args)-1] = func(ret interface{}, err error) {
+			defer a.catch()
+			cb(ret, err)
+		}
+	case func([]interface{}, error):
+		args[len(args)-1] = func(ret []interface{}, err error) {
+			defer a.catch()
+			cb(ret, err)
+		}
+	}
+
+	a.client.Attach(server)
+	a.client.AsynCall(id, args...)
+}
+
+// goroutine safe
+func (a *Actor) Stop() {
+	select {
+	case a.closeSig <- true:
+	default:
+	}
+}
+
+// records a panic for the supervisor and panics again to be logged as usual
+func (a *Actor) catch() {
+	if r := recover(); r != nil {
+		a.failure = r
+		panic(r)
+	}
+}
+
+func (a *Actor) guard(cb func()) func() {
+	return func() {
+		defer a.catch()
+		cb()
+	}
+}
+
+func (a *Actor) intercept(id interface{}, args []interface{}, next func() (interface{}, error)) (interface{}, error) {
+	defer a.catch()
+	return next()
+}
+
+func (a *Actor) run() {
+	defer a.skeleton.wgActors.Done()
+
+	for a != nil {
+		a = a.loop()
+	}
+}
+
+// returns the actor to run next, nil if stopped
+func (a *Actor) loop() *Actor {
+	for {
+		select {
+		case <-a.closeSig:
+			a.skeleton.removeActor(a)
+			a.destroy()
+			return nil
+		case ci := <-a.server.ChanCall:
+			a.server.Exec(ci)
+		case ri := <-a.client.ChanAsynRet:
+			a.client.Cb(ri)
+		case t := <-a.dispatcher.ChanTimer:
+			t.Cb()
+		}
+
+		if a.failure != nil {
+			return a.supervise()
+		}
+	}
+}
+
+func (a *Actor) supervise() *Actor {
+	r := a.failure
+	a.failure = nil
+	p := a.Policy.normalize()
+
+	switch p.Action {
+	case Ignore:
+		return a
+	case Restart:
+		if p.MaxRestarts <= 0 || a.restarts < p.MaxRestarts {
+			return a.restart(p)
+		}
+	}
+
+	a.skeleton.removeActor(a)
+	a.destroy()
+	a.skeleton.escalateActor(fmt.Errorf("actor %v: %v", a, r))
+	return nil
+}
+
+func (a *Actor) restart(p Policy) *Actor {
+	a.destroy()
+
+	backoff := p.MinBackoff
+	for i := 0; i < a.restarts && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	a.skeleton.logger.Release("actor %v restarts in %v", a, backoff)
+
+	select {
+	case <-a.closeSig:
+		a.skeleton.removeActor(a)
+		return nil
+	case <-time.After(backoff):
+	}
+
+	na, err := a.reinit()
+	if err != nil {
+		a.skeleton.removeActor(a)
+		a.skeleton.escalateActor(err)
+		return nil
+	}
+	if !a.skeleton.replaceActor(a, na) {
+		na.destroy()
+		return nil
+	}
+	return na
+}
+
+func (a *Actor) reinit() (na *Actor, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("actor %v: restart: %v", a, r)
+		}
+	}()
+
+	return a.skeleton.newActor(a.id, a.init, a.closeSig, a.restarts+1), nil
+}
+
+func (a *Actor) destroy() {
+	a.server.Close()
+	a.client.Close()
+	a.dispatcher.Close()
+
+	if a.OnDestroy != nil {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					a.skeleton.logger.Error("actor %v: destroy: %v", a, r)
+				}
+			}()
+			a.OnDestroy()
+		}()
+	}
+}
@@ -0,0 +1,216 @@
+package module
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a running skeleton, closed at the end of the test
+func startSkeleton(t *testing.T) *Skeleton {
+	s := &Skeleton{Name: "game", TimerDispatcherLen: 1, ActorChanRPCLen: 10}
+	s.Init()
+	closeSig := make(chan bool, 1)
+	done := make(chan struct{})
+	go func() {
+		s.Run(closeSig)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		closeSig <- true
+		<-done
+	})
+	return s
+}
+
+// the number of timers blocked on a dispatcher
+func blockedTimers() int {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	return strings.Count(string(buf), "timer.(*Dispatcher).AfterFunc.func")
+}
+
+func TestActorSpawn(t *testing.T) {
+	s := startSkeleton(t)
+	log := new(calls)
+	a, err := s.Spawn("a", func(a *Actor) {
+		a.RegisterChanRPC("ping", func(args []interface{}) interface{} {
+			return args[0]
+		})
+		a.AfterFunc(time.Millisecond, func() {
+			log.add("timer")
+		})
+		a.OnDestroy = func() {
+			log.add("destroy")
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Actor("a") != a || s.ActorNum() != 1 {
+		t.Fatal("the actor is not found")
+	}
+	if _, err := s.Spawn("a", func(a *Actor) {}); err == nil {
+		t.Fatal("spawned twice")
+	}
+
+	ret, err := a.Server().Call1("ping", "hi")
+	if err != nil || ret != "hi" {
+		t.Fatalf("got %v, %v", ret, err)
+	}
+	eventually(t, "the timer", func() bool {
+		return log.count("timer") == 1
+	})
+
+	a.Stop()
+	eventually(t, "the actor to stop", func() bool {
+		return s.ActorNum() == 0
+	})
+	if got := log.get(); len(got) != 2 || got[1] != "destroy" {
+		t.Fatalf("calls %v", got)
+	}
+	if _, err := a.Server().Call1("ping", "hi"); err == nil {
+		t.Fatal("the mailbox of a stopped actor is open")
+	}
+}
+
+func TestActorRestart(t *testing.T) {
+	s := startSkeleton(t)
+	log := new(calls)
+	_, err := s.Spawn("a", func(a *Actor) {
+		log.add("init")
+		a.Policy = Policy{Action: Restart, MinBackoff: 10 * time.Millisecond}
+		a.RegisterChanRPC("crash", func(args []interface{}) {
+			// not read by the restarted actor
+			for i := 0; i < 3; i++ {
+				a.AfterFunc(20*time.Millisecond, func() {
+					log.add("timer")
+				})
+			}
+			panic("game over")
+		})
+		a.RegisterChanRPC("ping", func(args []interface{}) interface{} {
+			return args[0]
+		})
+		a.OnDestroy = func() {
+			log.add("destroy")
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := s.Actor("a")
+	if err := old.Server().Call0("crash"); err == nil {
+		t.Fatal("the actor did not crash")
+	}
+	eventually(t, "the restart", func() bool {
+		return log.count("init") == 2
+	})
+	a := s.Actor("a")
+	if a == old || a.restarts != 1 {
+		t.Fatal("the actor is not replaced")
+	}
+	ret, err := a.Server().Call1("ping", "hi")
+	if err != nil || ret != "hi" {
+		t.Fatalf("got %v, %v", ret, err)
+	}
+
+	// the timers of the old actor are dropped
+	time.Sleep(50 * time.Millisecond)
+	eventually(t, "the timers", func() bool {
+		return blockedTimers() == 0
+	})
+	if n := log.count("timer"); n != 0 {
+		t.Fatalf("%v timers of the old actor called", n)
+	}
+	if n := log.count("destroy"); n != 1 {
+		t.Fatalf("destroyed %v times", n)
+	}
+}
+
+func TestActorDestroy(t *testing.T) {
+	s := startSkeleton(t)
+	log := new(calls)
+	a, err := s.Spawn("a", func(a *Actor) {
+		for i := 0; i < 3; i++ {
+			a.AfterFunc(20*time.Millisecond, func() {
+				log.add("timer")
+			})
+		}
+		a.OnDestroy = func() {
+			log.add("destroy")
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the pending timers do not block
+	a.Stop()
+	time.Sleep(50 * time.Millisecond)
+	eventually(t, "the timers", func() bool {
+		return blockedTimers() == 0
+	})
+	if got := log.get(); len(got) != 1 || got[0] != "destroy" {
+		t.Fatalf("calls %v", got)
+	}
+
+	// nor those of an actor whose init panics
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("init did not panic")
+			}
+		}()
+		s.Spawn("b", func(a *Actor) {
+			a.AfterFunc(time.Millisecond, func() {})
+			a.AfterFunc(time.Millisecond, func() {})
+			panic("game over")
+		})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	eventually(t, "the timers", func() bool {
+		return blockedTimers() == 0
+	})
+	if s.ActorNum() != 0 {
+		t.Fatal("the actor b is reserved")
+	}
+}
+
+func TestCloseActors(t *testing.T) {
+	log := new(calls)
+	s := &Skeleton{Name: "game"}
+	s.Init()
+	closeSig := make(chan bool, 1)
+	done := make(chan struct{})
+	go func() {
+		s.Run(closeSig)
+		close(done)
+	}()
+	for _, id := range []string{"a", "b"} {
+		id := id
+		_, err := s.Spawn(id, func(a *Actor) {
+			a.OnDestroy = func() {
+				log.add("destroy " + id)
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	closeSig <- true
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run does not return")
+	}
+	if n := len(log.get()); n != 2 {
+		t.Fatalf("%v actors destroyed", n)
+	}
+	if _, err := s.Spawn("c", func(a *Actor) {}); err == nil {
+		t.Fatal("spawned on a closed skeleton")
+	}
+}
@@ -1,10 +1,18 @@
 package module
 
 import (
+	"context"
+	"fmt"
+	"github.com/name5566/leaf/cluster"
 	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/console"
 	"github.com/name5566/leaf/log"
+	"reflect"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 type Module interface {
@@ -13,60 +21,477 @@ type Module interface {
 	Run(closeSig chan bool)
 }
 
+// optional, the type name of the module is used if not implemented
+type Named interface {
+	Name() string
+}
+
+// optional, a module not implementing it depends on the module registered
+// before it
+type Dependent interface {
+	// names of the modules which must be initialized first
+	DependsOn() []string
+}
+
+// the services of the server the modules belong to, see leaf.App
+type Env struct {
+	Conf *conf.Config
+	// the logger of the package log if nil
+	Logger   *log.Logger
+	Cluster  *cluster.Cluster
+	Console  *console.Console
+	Reloader *conf.Reloader
+}
+
+// optional, e.g. implemented by Skeleton
+type EnvSetter interface {
+	// called before OnInit if the manager has an Env
+	SetEnv(env *Env)
+}
+
 type module struct {
-	mi       Module
-	closeSig chan bool
-	wg       sync.WaitGroup
+	manager   *Manager
+	mi        Module
+	name      string
+	deps      []*module
+	level     int
+	closeSig  chan bool
+	wg        sync.WaitGroup
+	state     State
+	startTime time.Time
+	restarts  int
 }
 
-var mods []*module
+// a Manager holds the modules of one server
+type Manager struct {
+	conf           *conf.Config
+	env            *Env
+	mods           []*module
+	mutexMods      sync.RWMutex
+	chanEscalation chan error
+}
+
+// the package level functions use the modules of leaf.Run
+var std = NewManager(nil)
+
+// the modules of leaf.Run
+func Default() *Manager {
+	return std
+}
+
+// the settings of the package conf are used if c is nil
+func NewManager(c *conf.Config) *Manager {
+	mgr := new(Manager)
+	mgr.conf = c
+	mgr.chanEscalation = make(chan error, 1)
+	return mgr
+}
+
+// you must call the function before calling Init
+func (mgr *Manager) SetEnv(env *Env) {
+	mgr.env = env
+}
+
+func (mgr *Manager) logger() *log.Logger {
+	if mgr.env == nil {
+		return nil
+	}
+	return mgr.env.Logger
+}
 
 func Register(mi Module) {
+	std.Register(mi)
+}
+
+func (mgr *Manager) Register(mi Module) {
 	m := new(module)
+	m.manager = mgr
 	m.mi = mi
 	m.closeSig = make(chan bool, 1)
+	m.state = StateRegistered
 
-	mods = append(mods, m)
+	if n, ok := mi.(Named); ok {
+		m.name = n.Name()
+	} else {
+		m.name = reflect.TypeOf(mi).String()
+	}
+
+	mgr.mutexMods.Lock()
+	mgr.mods = append(mgr.mods, m)
+	mgr.mutexMods.Unlock()
 }
 
 func Init() {
-	for i := 0; i < len(mods); i++ {
-		mods[i].mi.OnInit()
+	err := std.Init()
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+// no module runs if an error is returned, the modules are destroyed if they
+// are initialized
+func (mgr *Manager) Init() error {
+	if mgr.conf == nil {
+		mgr.conf = conf.Global()
+	}
+	err := mgr.sortModules()
+	if err != nil {
+		return err
+	}
+
+	mods := mgr.mods
+
+	// one at a time, OnInit may use registries which are not goroutine safe
+	for i, m := range mods {
+		err := m.init()
+		if err != nil {
+			mgr.destroyModules(mods[:i])
+			m.setState(StateStopped)
+			return err
+		}
+	}
+
+	for _, m := range mods {
+		s, ok := m.mi.(Starter)
+		if !ok {
+			continue
+		}
+		err := s.OnStart()
+		if err != nil {
+			mgr.destroyModules(mods)
+			return fmt.Errorf("module %v: %v", m.name, err)
+		}
 	}
 
 	for i := 0; i < len(mods); i++ {
 		m := mods[i]
+		m.setState(StateRunning)
 		m.wg.Add(1)
-		go run(m)
+		go m.run()
+	}
+
+	return nil
+}
+
+// returns an error if OnInit panics
+func (m *module) init() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			m.logPanic(r)
+			err = fmt.Errorf("module %v: init: %v", m.name, r)
+		}
+	}()
+
+	m.setState(StateInitializing)
+	if s, ok := m.mi.(EnvSetter); ok && m.manager.env != nil {
+		s.SetEnv(m.manager.env)
+	}
+	m.mi.OnInit()
+	return
+}
+
+// in reverse order
+func (mgr *Manager) destroyModules(mods []*module) {
+	for i := len(mods) - 1; i >= 0; i-- {
+		mgr.safeCall(mods[i].mi.OnDestroy)
+		mods[i].setState(StateStopped)
+	}
+}
+
+// sorts the modules by dependency level, the order of registration is kept
+// within a level
+func (mgr *Manager) sortModules() error {
+	mods := mgr.mods
+	byName := make(map[string]*module)
+	for _, m := range mods {
+		if _, ok := byName[m.name]; ok {
+			return fmt.Errorf("module %v is already registered", m.name)
+		}
+		byName[m.name] = m
+	}
+
+	for i, m := range mods {
+		d, ok := m.mi.(Dependent)
+		if !ok {
+			if i > 0 {
+				m.deps = []*module{mods[i-1]}
+			}
+			continue
+		}
+
+		for _, name := range d.DependsOn() {
+			dep, ok := byName[name]
+			if !ok {
+				return fmt.Errorf("module %v: unknown dependency %v", m.name, name)
+			}
+			m.deps = append(m.deps, dep)
+		}
+	}
+
+	// 0: unvisited, 1: visiting, 2: visited
+	state := make(map[*module]int)
+	var path []*module
+	var visit func(m *module) error
+	visit = func(m *module) error {
+		switch state[m] {
+		case 1:
+			var names []string
+			for i := len(path) - 1; i >= 0; i-- {
+				names = append([]string{path[i].name}, names...)
+				if path[i] == m {
+					break
+				}
+			}
+			return fmt.Errorf("module dependency cycle: %v -> %v", strings.Join(names, " -> "), m.name)
+		case 2:
+			return nil
+		}
+
+		state[m] = 1
+		path = append(path, m)
+		m.level = 0
+		for _, dep := range m.deps {
+			err := visit(dep)
+			if err != nil {
+				return err
+			}
+			if dep.level+1 > m.level {
+				m.level = dep.level + 1
+			}
+		}
+		path = path[:len(path)-1]
+		state[m] = 2
+		return nil
+	}
+	for _, m := range mods {
+		err := visit(m)
+		if err != nil {
+			return err
+		}
 	}
+
+	sorted := make([]*module, len(mods))
+	copy(sorted, mods)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].level < sorted[j].level
+	})
+
+	mgr.mutexMods.Lock()
+	mgr.mods = sorted
+	mgr.mutexMods.Unlock()
+	return nil
+}
+
+// optional
+type Starter interface {
+	// called after all the modules are initialized and before any module
+	// runs, e.g. to listen
+	OnStart() error
 }
 
+// optional
+type Drainer interface {
+	// called on every module before any module is closed, e.g. to stop
+	// accepting clients
+	OnDrain()
+}
+
+func Drain() {
+	std.Drain()
+}
+
+func (mgr *Manager) Drain() {
+	mods := mgr.mods
+	for i := len(mods) - 1; i >= 0; i-- {
+		if d, ok := mods[i].mi.(Drainer); ok {
+			mgr.safeCall(d.OnDrain)
+		}
+	}
+}
+
+// waits for each module within its drain timeout and for all the modules
+// within conf.ShutdownTimeout, a module not closed in time is not destroyed
 func Destroy() {
+	std.Destroy()
+}
+
+func (mgr *Manager) Destroy() {
+	mgr.DestroyContext(context.Background())
+}
+
+// the same as Destroy but stops waiting when ctx is done, returns an error if
+// a module is not closed in time
+func (mgr *Manager) DestroyContext(ctx context.Context) error {
+	if mgr.conf == nil {
+		mgr.conf = conf.Global()
+	}
+	var deadline time.Time
+	if mgr.conf.ShutdownTimeout > 0 {
+		deadline = time.Now().Add(mgr.conf.ShutdownTimeout)
+	}
+
+	var stuck []string
+	mods := mgr.mods
 	for i := len(mods) - 1; i >= 0; i-- {
 		m := mods[i]
+		m.setState(StateStopping)
 		m.closeSig <- true
-		m.wg.Wait()
-		destroy(m)
+
+		timeout := mgr.conf.ModuleDrainTimeout
+		if t, ok := mgr.conf.ModuleDrainTimeouts[m.name]; ok {
+			timeout = t
+		}
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				mgr.logger().Error("module %v: shutdown timeout", m.name)
+				stuck = append(stuck, m.name)
+				continue
+			}
+			if timeout <= 0 || timeout > remaining {
+				timeout = remaining
+			}
+		}
+
+		err := wait(ctx, &m.wg, timeout)
+		if err != nil {
+			mgr.logger().Error("module %v: %v", m.name, err)
+			stuck = append(stuck, m.name)
+			continue
+		}
+		mgr.safeCall(m.mi.OnDestroy)
+		m.setState(StateStopped)
+	}
+
+	if len(stuck) > 0 {
+		return fmt.Errorf("modules not closed in time: %v", strings.Join(stuck, ", "))
+	}
+	return nil
+}
+
+// no limit if timeout is 0
+func wait(ctx context.Context, wg *sync.WaitGroup, timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var chanTimeout <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		chanTimeout = t.C
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-chanTimeout:
+		return fmt.Errorf("drain timeout (%v)", timeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *module) run() {
+	defer m.wg.Done()
+
+	policy := m.policy()
+	backoff := policy.MinBackoff
+	for {
+		if !m.runOnce() {
+			m.manager.mutexMods.Lock()
+			if m.state == StateRunning {
+				m.state = StateCrashed
+				m.manager.logger().Error("module %v exited unexpectedly", m.name)
+			}
+			m.manager.mutexMods.Unlock()
+			return
+		}
+
+		m.manager.mutexMods.RLock()
+		stopping := m.state == StateStopping
+		m.manager.mutexMods.RUnlock()
+		if stopping {
+			return
+		}
+
+		switch policy.Action {
+		case Restart:
+			if policy.MaxRestarts > 0 && m.restarts >= policy.MaxRestarts {
+				m.setState(StateCrashed)
+				m.manager.escalate(fmt.Errorf("module %v restarted too many times", m.name))
+				return
+			}
+
+			m.manager.logger().Release("restarting module %v in %v", m.name, backoff)
+			select {
+			case <-m.closeSig:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > policy.MaxBackoff {
+				backoff = policy.MaxBackoff
+			}
+
+			// not restarted if Destroy is called during the backoff
+			m.manager.mutexMods.Lock()
+			if m.state == StateStopping {
+				m.manager.mutexMods.Unlock()
+				return
+			}
+			m.restarts++
+			m.state = StateRunning
+			m.startTime = time.Now()
+			m.manager.mutexMods.Unlock()
+		case Ignore:
+			m.setState(StateCrashed)
+			return
+		default:
+			m.setState(StateCrashed)
+			m.manager.escalate(fmt.Errorf("module %v panicked", m.name))
+			return
+		}
 	}
 }
 
-func run(m *module) {
+// returns true if Run panics
+func (m *module) runOnce() (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			m.logPanic(r)
+		}
+	}()
+
 	m.mi.Run(m.closeSig)
-	m.wg.Done()
+	return
+}
+
+func (m *module) logPanic(r interface{}) {
+	if conf.LenStackBuf > 0 {
+		buf := make([]byte, conf.LenStackBuf)
+		l := runtime.Stack(buf, false)
+		m.manager.logger().Error("module %v: %v: %s", m.name, r, buf[:l])
+	} else {
+		m.manager.logger().Error("module %v: %v", m.name, r)
+	}
 }
 
-func destroy(m *module) {
+func (mgr *Manager) safeCall(f func()) {
 	defer func() {
 		if r := recover(); r != nil {
 			if conf.LenStackBuf > 0 {
 				buf := make([]byte, conf.LenStackBuf)
 				l := runtime.Stack(buf, false)
-				log.Error("%v: %s", r, buf[:l])
+				mgr.logger().Error("%v: %s", r, buf[:l])
 			} else {
-				log.Error("%v", r)
+				mgr.logger().Error("%v", r)
 			}
 		}
 	}()
 
-	m.mi.OnDestroy()
+	f()
 }
@@ -0,0 +1,258 @@
+package module
+
+import (
+	"context"
+	"github.com/name5566/leaf/conf"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a module recording its calls in a shared log
+type testModule struct {
+	name   string
+	deps   []string
+	log    *calls
+	onInit func()
+	run    func(closeSig chan bool)
+}
+
+type calls struct {
+	mutex sync.Mutex
+	names []string
+}
+
+func (c *calls) add(name string) {
+	c.mutex.Lock()
+	c.names = append(c.names, name)
+	c.mutex.Unlock()
+}
+
+func (c *calls) get() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.names...)
+}
+
+func (c *calls) count(name string) int {
+	n := 0
+	for _, s := range c.get() {
+		if s == name {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *testModule) Name() string {
+	return m.name
+}
+
+func (m *testModule) OnInit() {
+	m.log.add("init " + m.name)
+	if m.onInit != nil {
+		m.onInit()
+	}
+}
+
+func (m *testModule) OnDestroy() {
+	m.log.add("destroy " + m.name)
+}
+
+func (m *testModule) Run(closeSig chan bool) {
+	if m.run != nil {
+		m.run(closeSig)
+		return
+	}
+	<-closeSig
+}
+
+// the same as testModule but declares its dependencies
+type testDependent struct {
+	testModule
+}
+
+func (m *testDependent) DependsOn() []string {
+	return m.deps
+}
+
+func newManager(log *calls, mods ...*testModule) *Manager {
+	mgr := NewManager(&conf.Config{})
+	for _, m := range mods {
+		m.log = log
+		if m.deps != nil {
+			mgr.Register(&testDependent{*m})
+		} else {
+			mgr.Register(m)
+		}
+	}
+	return mgr
+}
+
+func TestSortModules(t *testing.T) {
+	tests := []struct {
+		name   string
+		mods   []*testModule
+		levels map[string]int
+		order  []string
+		err    string
+	}{
+		{"registration order", []*testModule{
+			{name: "a"}, {name: "b"}, {name: "c"},
+		}, map[string]int{"a": 0, "b": 1, "c": 2}, []string{"a", "b", "c"}, ""},
+		{"dependencies", []*testModule{
+			{name: "game", deps: []string{"db", "cluster"}},
+			{name: "gate", deps: []string{"game"}},
+			{name: "db", deps: []string{}},
+			{name: "cluster", deps: []string{}},
+			{name: "login", deps: []string{"db"}},
+		}, map[string]int{"db": 0, "cluster": 0, "game": 1, "login": 1, "gate": 2},
+			[]string{"db", "cluster", "game", "login", "gate"}, ""},
+		{"cycle", []*testModule{
+			{name: "a", deps: []string{"c"}},
+			{name: "b", deps: []string{"a"}},
+			{name: "c", deps: []string{"b"}},
+		}, nil, nil, "module dependency cycle: a -> c -> b -> a"},
+		{"self", []*testModule{
+			{name: "a", deps: []string{"a"}},
+		}, nil, nil, "module dependency cycle: a -> a"},
+		{"unknown dependency", []*testModule{
+			{name: "a"}, {name: "b", deps: []string{"db"}},
+		}, nil, nil, "module b: unknown dependency db"},
+		{"same name", []*testModule{
+			{name: "a"}, {name: "a"},
+		}, nil, nil, "module a is already registered"},
+	}
+
+	for _, test := range tests {
+		mgr := newManager(new(calls), test.mods...)
+		err := mgr.sortModules()
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%v: got %v, want %v", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+
+		var order []string
+		for _, m := range mgr.mods {
+			order = append(order, m.name)
+			if m.level != test.levels[m.name] {
+				t.Errorf("%v: level of %v is %v, want %v", test.name, m.name, m.level, test.levels[m.name])
+			}
+		}
+		if !reflect.DeepEqual(order, test.order) {
+			t.Errorf("%v: order %v, want %v", test.name, order, test.order)
+		}
+	}
+}
+
+func TestInitPanic(t *testing.T) {
+	log := new(calls)
+	mgr := newManager(log,
+		&testModule{name: "a"},
+		&testModule{name: "b", onInit: func() { panic("game over") }},
+		&testModule{name: "c"},
+	)
+
+	err := mgr.Init()
+	if err == nil || !strings.Contains(err.Error(), "game over") {
+		t.Fatalf("got %v, want the panic", err)
+	}
+	// the modules initialized are destroyed, c is not initialized
+	want := []string{"init a", "init b", "destroy a"}
+	if got := log.get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("calls %v, want %v", got, want)
+	}
+	for _, i := range mgr.List() {
+		state := StateStopped
+		if i.Name == "c" {
+			state = StateRegistered
+		}
+		if i.State != state {
+			t.Errorf("module %v is %v, want %v", i.Name, i.State, state)
+		}
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	stuck := func(closeSig chan bool) {
+		<-release
+	}
+
+	tests := []struct {
+		name  string
+		conf  conf.Config
+		ctx   time.Duration
+		stuck string
+		calls []string
+	}{
+		// a is not waited for once the shutdown timeout is over
+		{"shutdown timeout", conf.Config{ShutdownTimeout: 50 * time.Millisecond}, 0,
+			"b, a", []string{"destroy c"}},
+		{"drain timeout", conf.Config{ModuleDrainTimeout: time.Minute, ModuleDrainTimeouts: map[string]time.Duration{"b": 50 * time.Millisecond}}, 0,
+			"b", []string{"destroy c", "destroy a"}},
+		// nor once ctx is done, unless a has closed first
+		{"context", conf.Config{}, 50 * time.Millisecond,
+			"", []string{"destroy c"}},
+	}
+
+	for _, test := range tests {
+		log := new(calls)
+		mgr := newManager(log, &testModule{name: "a"}, &testModule{name: "b", run: stuck}, &testModule{name: "c"})
+		c := test.conf
+		mgr.conf = &c
+		err := mgr.Init()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		if test.ctx > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, test.ctx)
+			defer cancel()
+		}
+		start := time.Now()
+		err = mgr.DestroyContext(ctx)
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%v: returned after %v", test.name, d)
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), "modules not closed in time: b") {
+			t.Fatalf("%v: got %v", test.name, err)
+		}
+		if test.stuck != "" && err.Error() != "modules not closed in time: "+test.stuck {
+			t.Errorf("%v: got %v", test.name, err)
+		}
+
+		// b is not destroyed
+		got := log.get()[3:]
+		if test.stuck == "" && len(got) > len(test.calls) {
+			got = got[:len(test.calls)]
+		}
+		if !reflect.DeepEqual(got, test.calls) {
+			t.Errorf("%v: calls %v, want %v", test.name, got, test.calls)
+		}
+	}
+}
+
+func TestDestroyUninitialized(t *testing.T) {
+	log := new(calls)
+	mgr := NewManager(nil)
+	mgr.Register(&testModule{name: "a", log: log})
+	err := mgr.DestroyContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := log.get(); !reflect.DeepEqual(got, []string{"destroy a"}) {
+		t.Fatalf("calls %v", got)
+	}
+}
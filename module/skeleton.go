@@ -2,22 +2,38 @@ package module
 
 import (
 	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/conf"
 	"github.com/name5566/leaf/console"
 	"github.com/name5566/leaf/go"
+	"github.com/name5566/leaf/log"
 	"github.com/name5566/leaf/timer"
+	"sync"
 	"time"
 )
 
 type Skeleton struct {
+	Name               string
 	GoLen              int
 	TimerDispatcherLen int
 	AsynCallLen        int
+	ActorChanRPCLen    int
 	ChanRPCServer      *chanrpc.Server
-	g                  *g.Go
-	dispatcher         *timer.Dispatcher
-	client             *chanrpc.Client
-	server             *chanrpc.Server
-	commandServer      *chanrpc.Server
+	// the console of the App (see SetEnv) or of leaf.Run if nil
+	Console *console.Console
+	// the reloader of the App or of leaf.Run if nil
+	Reloader      *conf.Reloader
+	logger        *log.Logger
+	g             *g.Go
+	dispatcher    *timer.Dispatcher
+	client        *chanrpc.Client
+	server        *chanrpc.Server
+	commandServer *chanrpc.Server
+	ticker        *ticker
+	actors        map[interface{}]*Actor
+	mutexActors   sync.RWMutex
+	wgActors      sync.WaitGroup
+	actorsClosed  bool
+	chanActorErr  chan error
 }
 
 func (s *Skeleton) Init() {
@@ -30,6 +46,9 @@ func (s *Skeleton) Init() {
 	if s.AsynCallLen <= 0 {
 		s.AsynCallLen = 0
 	}
+	if s.ActorChanRPCLen <= 0 {
+		s.ActorChanRPCLen = 0
+	}
 
 	s.g = g.New(s.GoLen)
 	s.dispatcher = timer.NewDispatcher(s.TimerDispatcherLen)
@@ -39,13 +58,30 @@ func (s *Skeleton) Init() {
 	if s.server == nil {
 		s.server = chanrpc.NewServer(0)
 	}
+	if s.server.Name == "" {
+		s.server.Name = s.Name
+	}
 	s.commandServer = chanrpc.NewServer(0)
+	s.commandServer.Name = s.Name + " (command)"
+	s.actors = make(map[interface{}]*Actor)
+	s.chanActorErr = make(chan error, 1)
 }
 
 func (s *Skeleton) Run(closeSig chan bool) {
+	var tickC <-chan time.Time
+	if s.ticker != nil {
+		tickC = s.ticker.start()
+		defer s.ticker.stop()
+	}
+
+	// keep serving while the actors stop, they may call the module
+	var actorsDone chan struct{}
 	for {
 		select {
 		case <-closeSig:
+			closeSig = nil
+			actorsDone = s.closeActors()
+		case <-actorsDone:
 			s.commandServer.Close()
 			s.server.Close()
 			for !s.g.Idle() || !s.client.Idle() {
@@ -63,10 +99,25 @@ func (s *Skeleton) Run(closeSig chan bool) {
 			s.g.Cb(cb)
 		case t := <-s.dispatcher.ChanTimer:
 			t.Cb()
+		case <-tickC:
+			s.ticker.tick(s.Name, s.logger)
+		case err := <-s.chanActorErr:
+			panic(err)
 		}
 	}
 }
 
+// sets Console and Reloader if nil, called by the module manager
+func (s *Skeleton) SetEnv(env *Env) {
+	if s.Console == nil {
+		s.Console = env.Console
+	}
+	if s.Reloader == nil {
+		s.Reloader = env.Reloader
+	}
+	s.logger = env.Logger
+}
+
 func (s *Skeleton) AfterFunc(d time.Duration, cb func()) *timer.Timer {
 	if s.TimerDispatcherLen == 0 {
 		panic("invalid TimerDispatcherLen")
@@ -117,5 +168,23 @@ func (s *Skeleton) RegisterChanRPC(id interface{}, f interface{}) {
 }
 
 func (s *Skeleton) RegisterCommand(name string, help string, f interface{}) {
-	console.Register(name, help, f, s.commandServer)
+	c := s.Console
+	if c == nil {
+		c = console.Default()
+	}
+	c.Register(name, help, f, s.commandServer)
+}
+
+// f is called on the module goroutine when the config is reloaded
+// you must call the function after calling Init
+func (s *Skeleton) OnConfigReload(f func(c *conf.Config, old *conf.Config)) {
+	s.server.Register("ConfigReload", func(args []interface{}) {
+		f(args[0].(*conf.Config), args[1].(*conf.Config))
+	})
+
+	r := s.Reloader
+	if r == nil {
+		r = conf.DefaultReloader()
+	}
+	r.Subscribe(s.server)
 }
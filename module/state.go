@@ -0,0 +1,145 @@
+package module
+
+import (
+	"fmt"
+	"github.com/name5566/leaf/console"
+	"time"
+)
+
+type State int
+
+const (
+	StateRegistered State = iota
+	StateInitializing
+	StateRunning
+	StateStopping
+	StateStopped
+	// Run returned before the module was closed
+	StateCrashed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateRegistered:
+		return "registered"
+	case StateInitializing:
+		return "initializing"
+	case StateRunning:
+		return "running"
+	case StateStopping:
+		return "stopping"
+	case StateStopped:
+		return "stopped"
+	case StateCrashed:
+		return "crashed"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// optional
+type HealthChecker interface {
+	// must goroutine safe
+	Health() error
+}
+
+type Info struct {
+	Name  string
+	State State
+	// the time Run was called
+	StartTime time.Time
+	Restarts  int
+	// nil if healthy or Health not implemented
+	Health error
+}
+
+func init() {
+	console.RegisterFunc("module", "state and health of the modules", std.Command)
+}
+
+func (m *module) setState(state State) {
+	m.manager.mutexMods.Lock()
+	defer m.manager.mutexMods.Unlock()
+
+	m.state = state
+	if state == StateRunning {
+		m.startTime = time.Now()
+	}
+}
+
+func (m *module) info() Info {
+	m.manager.mutexMods.RLock()
+	i := Info{
+		Name:      m.name,
+		State:     m.state,
+		StartTime: m.startTime,
+		Restarts:  m.restarts,
+	}
+	m.manager.mutexMods.RUnlock()
+
+	if h, ok := m.mi.(HealthChecker); ok && i.State == StateRunning {
+		i.Health = h.Health()
+	}
+	return i
+}
+
+// the modules in the order of initialization once initialized
+// goroutine safe
+func List() []Info {
+	return std.List()
+}
+
+// goroutine safe
+func (mgr *Manager) List() []Info {
+	mgr.mutexMods.RLock()
+	ms := make([]*module, len(mgr.mods))
+	copy(ms, mgr.mods)
+	mgr.mutexMods.RUnlock()
+
+	infos := make([]Info, len(ms))
+	for i, m := range ms {
+		infos[i] = m.info()
+	}
+	return infos
+}
+
+// goroutine safe
+func Get(name string) (Info, bool) {
+	return std.Get(name)
+}
+
+// goroutine safe
+func (mgr *Manager) Get(name string) (Info, bool) {
+	for _, i := range mgr.List() {
+		if i.Name == name {
+			return i, true
+		}
+	}
+
+	return Info{}, false
+}
+
+// the module console command
+func (mgr *Manager) Command(args []string) string {
+	var output string
+	for i, info := range mgr.List() {
+		if i > 0 {
+			output += "\r\n"
+		}
+
+		output += fmt.Sprintf("%v: %v", info.Name, info.State)
+		if info.Restarts > 0 {
+			output += fmt.Sprintf(", restarted %v times", info.Restarts)
+		}
+		if info.State == StateRunning {
+			output += fmt.Sprintf(", up %v", time.Since(info.StartTime).Truncate(time.Second))
+			if info.Health != nil {
+				output += fmt.Sprintf(", unhealthy: %v", info.Health)
+			} else {
+				output += ", healthy"
+			}
+		}
+	}
+
+	return output
+}
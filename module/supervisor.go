@@ -0,0 +1,66 @@
+package module
+
+import (
+	"time"
+)
+
+// actions taken when Run panics
+const (
+	// shut down the server
+	Escalate = iota
+	// call Run again after a backoff
+	Restart
+	// leave the module crashed
+	Ignore
+)
+
+type Policy struct {
+	Action int
+	// the backoff doubles after each restart
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// escalate after MaxRestarts restarts, no limit if 0
+	MaxRestarts int
+}
+
+// optional, the Escalate policy is used if not implemented
+type Supervised interface {
+	SupervisionPolicy() Policy
+}
+
+func (m *module) policy() Policy {
+	var p Policy
+	if s, ok := m.mi.(Supervised); ok {
+		p = s.SupervisionPolicy()
+	}
+	return p.normalize()
+}
+
+func (p Policy) normalize() Policy {
+	if p.MinBackoff <= 0 {
+		p.MinBackoff = time.Second
+	}
+	if p.MaxBackoff < p.MinBackoff {
+		p.MaxBackoff = 30 * time.Second
+		if p.MaxBackoff < p.MinBackoff {
+			p.MaxBackoff = p.MinBackoff
+		}
+	}
+	return p
+}
+
+func (mgr *Manager) escalate(err error) {
+	select {
+	case mgr.chanEscalation <- err:
+	default:
+	}
+}
+
+// receives an error when a module asks to shut down the server
+func Escalation() <-chan error {
+	return std.Escalation()
+}
+
+func (mgr *Manager) Escalation() <-chan error {
+	return mgr.chanEscalation
+}
@@ -0,0 +1,151 @@
+package module
+
+import (
+	"github.com/name5566/leaf/conf"
+	"testing"
+	"time"
+)
+
+// a module whose Run panics the first panics times
+type panicModule struct {
+	testModule
+	panics int
+}
+
+func (m *panicModule) Run(closeSig chan bool) {
+	m.log.add("run")
+	if m.panics > 0 {
+		m.panics--
+		panic("game over")
+	}
+	<-closeSig
+}
+
+type supervisedModule struct {
+	panicModule
+	policy Policy
+}
+
+func (m *supervisedModule) SupervisionPolicy() Policy {
+	return m.policy
+}
+
+// waits until f returns true
+func eventually(t *testing.T, what string, f func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %v", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSupervision(t *testing.T) {
+	backoff := 10 * time.Millisecond
+	tests := []struct {
+		name     string
+		policy   *Policy
+		panics   int
+		state    State
+		restarts int
+		// the escalation error, empty if none
+		err string
+	}{
+		{"restart", &Policy{Action: Restart, MinBackoff: backoff}, 2,
+			StateRunning, 2, ""},
+		{"too many restarts", &Policy{Action: Restart, MinBackoff: backoff, MaxRestarts: 1}, 5,
+			StateCrashed, 1, "module a restarted too many times"},
+		{"ignore", &Policy{Action: Ignore}, 1,
+			StateCrashed, 0, ""},
+		{"escalate", &Policy{Action: Escalate}, 1,
+			StateCrashed, 0, "module a panicked"},
+		{"no policy", nil, 1,
+			StateCrashed, 0, "module a panicked"},
+	}
+
+	for _, test := range tests {
+		log := new(calls)
+		var mi Module = &panicModule{testModule{name: "a", log: log}, test.panics}
+		if test.policy != nil {
+			mi = &supervisedModule{*mi.(*panicModule), *test.policy}
+		}
+		mgr := NewManager(&conf.Config{})
+		mgr.Register(mi)
+		err := mgr.Init()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		eventually(t, test.name, func() bool {
+			i, _ := mgr.Get("a")
+			return i.State == test.state && i.Restarts == test.restarts
+		})
+		if test.err != "" {
+			select {
+			case err := <-mgr.Escalation():
+				if err.Error() != test.err {
+					t.Errorf("%v: escalated %v, want %v", test.name, err, test.err)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("%v: not escalated", test.name)
+			}
+		} else {
+			// not restarted or escalated later
+			time.Sleep(5 * backoff)
+			select {
+			case err := <-mgr.Escalation():
+				t.Errorf("%v: escalated %v", test.name, err)
+			default:
+			}
+		}
+		if i, _ := mgr.Get("a"); i.State != test.state || i.Restarts != test.restarts {
+			t.Errorf("%v: %v, restarted %v times, want %v and %v", test.name, i.State, i.Restarts, test.state, test.restarts)
+		}
+		if n := log.count("run"); n != test.restarts+1 {
+			t.Errorf("%v: Run called %v times, want %v", test.name, n, test.restarts+1)
+		}
+
+		mgr.Destroy()
+		if i, _ := mgr.Get("a"); i.State != StateStopped {
+			t.Errorf("%v: %v after Destroy", test.name, i.State)
+		}
+	}
+}
+
+func TestDestroyDuringBackoff(t *testing.T) {
+	log := new(calls)
+	mgr := NewManager(&conf.Config{})
+	mgr.Register(&supervisedModule{
+		panicModule{testModule{name: "a", log: log}, 1},
+		Policy{Action: Restart, MinBackoff: time.Minute},
+	})
+	err := mgr.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the panic", func() bool {
+		i, _ := mgr.Get("a")
+		return log.count("run") == 1 && i.State == StateRunning
+	})
+	// in the backoff
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		mgr.Destroy()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Destroy waits for the backoff")
+	}
+	if i, _ := mgr.Get("a"); i.State != StateStopped || i.Restarts != 0 {
+		t.Fatalf("%v, restarted %v times", i.State, i.Restarts)
+	}
+	if got := log.get(); len(got) != 3 || got[2] != "destroy a" {
+		t.Fatalf("calls %v", got)
+	}
+}
@@ -0,0 +1,98 @@
+package module
+
+import (
+	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/log"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// overruns are logged at most once per interval
+const overrunLogInterval = time.Second
+
+type ticker struct {
+	interval time.Duration
+	f        func(dt time.Duration)
+	timer    *time.Timer
+	next     time.Time
+	last     time.Time
+	overruns uint64
+
+	// not logged yet
+	skipped uint64
+	lastLog time.Time
+}
+
+// f is called on the module goroutine every interval with the time elapsed
+// since the previous call, the ticks are scheduled at fixed times so that
+// they do not drift and a tick late by an interval or more is skipped (an
+// overrun)
+// you must call the function before calling Run
+func (s *Skeleton) Tick(interval time.Duration, f func(dt time.Duration)) {
+	if interval <= 0 {
+		panic("invalid tick interval")
+	}
+
+	s.ticker = &ticker{interval: interval, f: f}
+}
+
+// the number of skipped ticks
+// goroutine safe
+func (s *Skeleton) TickOverruns() uint64 {
+	if s.ticker == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&s.ticker.overruns)
+}
+
+func (t *ticker) start() <-chan time.Time {
+	now := time.Now()
+	t.last = now
+	t.next = now.Add(t.interval)
+	t.timer = time.NewTimer(t.interval)
+	return t.timer.C
+}
+
+func (t *ticker) stop() {
+	t.timer.Stop()
+}
+
+func (t *ticker) tick(name string, logger *log.Logger) {
+	now := time.Now()
+	dt := now.Sub(t.last)
+	t.last = now
+	t.call(dt, logger)
+
+	t.next = t.next.Add(t.interval)
+	end := time.Now()
+	if behind := end.Sub(t.next); behind >= 0 {
+		skipped := behind/t.interval + 1
+		t.next = t.next.Add(skipped * t.interval)
+		atomic.AddUint64(&t.overruns, uint64(skipped))
+		t.skipped += uint64(skipped)
+	}
+	if t.skipped > 0 && end.Sub(t.lastLog) >= overrunLogInterval {
+		logger.Error("module %v: tick overrun, %v ticks skipped", name, t.skipped)
+		t.skipped = 0
+		t.lastLog = end
+	}
+
+	t.timer.Reset(t.next.Sub(end))
+}
+
+func (t *ticker) call(dt time.Duration, logger *log.Logger) {
+	defer func() {
+		if r := recover(); r != nil {
+			if conf.LenStackBuf > 0 {
+				buf := make([]byte, conf.LenStackBuf)
+				l := runtime.Stack(buf, false)
+				logger.Error("%v: %s", r, buf[:l])
+			} else {
+				logger.Error("%v", r)
+			}
+		}
+	}()
+
+	t.f(dt)
+}
@@ -14,10 +14,17 @@ type TCPClient struct {
 	ConnectInterval time.Duration
 	PendingWriteNum int
 	AutoReconnect   bool
-	NewAgent        func(*TCPConn) Agent
-	conns           ConnSet
-	wg              sync.WaitGroup
-	closeFlag       bool
+	// a connection is given up after so many failed retries, no limit if 0
+	ConnectRetries int
+	// optional, called when a connection is given up
+	OnGiveUp func()
+	NewAgent func(*TCPConn) Agent
+	// the logger of the package log if nil
+	Logger    *log.Logger
+	conns     ConnSet
+	wg        sync.WaitGroup
+	closeFlag bool
+	closeChan chan struct{}
 
 	// msg parser
 	LenMsgLen    int
@@ -42,25 +49,26 @@ func (client *TCPClient) init() {
 
 	if client.ConnNum <= 0 {
 		client.ConnNum = 1
-		log.Release("invalid ConnNum, reset to %v", client.ConnNum)
+		client.Logger.Release("invalid ConnNum, reset to %v", client.ConnNum)
 	}
 	if client.ConnectInterval <= 0 {
 		client.ConnectInterval = 3 * time.Second
-		log.Release("invalid ConnectInterval, reset to %v", client.ConnectInterval)
+		client.Logger.Release("invalid ConnectInterval, reset to %v", client.ConnectInterval)
 	}
 	if client.PendingWriteNum <= 0 {
 		client.PendingWriteNum = 100
-		log.Release("invalid PendingWriteNum, reset to %v", client.PendingWriteNum)
+		client.Logger.Release("invalid PendingWriteNum, reset to %v", client.PendingWriteNum)
 	}
 	if client.NewAgent == nil {
-		log.Fatal("NewAgent must not be nil")
+		client.Logger.Fatal("NewAgent must not be nil")
 	}
 	if client.conns != nil {
-		log.Fatal("client is running")
+		client.Logger.Fatal("client is running")
 	}
 
 	client.conns = make(ConnSet)
 	client.closeFlag = false
+	client.closeChan = make(chan struct{})
 
 	// msg parser
 	msgParser := NewMsgParser()
@@ -69,16 +77,34 @@ func (client *TCPClient) init() {
 	client.msgParser = msgParser
 }
 
+// returns nil if closed or given up
 func (client *TCPClient) dial() net.Conn {
-	for {
+	for retries := 0; ; retries++ {
 		conn, err := net.Dial("tcp", client.Addr)
 		if err == nil || client.closeFlag {
 			return conn
 		}
 
-		log.Release("connect to %v error: %v", client.Addr, err)
-		time.Sleep(client.ConnectInterval)
-		continue
+		client.Logger.Release("connect to %v error: %v", client.Addr, err)
+		if client.ConnectRetries > 0 && retries >= client.ConnectRetries {
+			return nil
+		}
+		if !client.sleep() {
+			return nil
+		}
+	}
+}
+
+// returns false if closed while sleeping
+func (client *TCPClient) sleep() bool {
+	t := time.NewTimer(client.ConnectInterval)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-client.closeChan:
+		return false
 	}
 }
 
@@ -88,6 +114,16 @@ func (client *TCPClient) connect() {
 reconnect:
 	conn := client.dial()
 	if conn == nil {
+		client.Lock()
+		closed := client.closeFlag
+		client.Unlock()
+		if closed {
+			return
+		}
+		client.Logger.Release("connect to %v: given up", client.Addr)
+		if client.OnGiveUp != nil {
+			client.OnGiveUp()
+		}
 		return
 	}
 
@@ -100,7 +136,7 @@ reconnect:
 	client.conns[conn] = struct{}{}
 	client.Unlock()
 
-	tcpConn := newTCPConn(conn, client.PendingWriteNum, client.msgParser)
+	tcpConn := newTCPConn(conn, client.PendingWriteNum, client.msgParser, 0, 0, client.Logger)
 	agent := client.NewAgent(tcpConn)
 	agent.Run()
 
@@ -111,14 +147,16 @@ reconnect:
 	client.Unlock()
 	agent.OnClose()
 
-	if client.AutoReconnect {
-		time.Sleep(client.ConnectInterval)
+	if client.AutoReconnect && client.sleep() {
 		goto reconnect
 	}
 }
 
 func (client *TCPClient) Close() {
 	client.Lock()
+	if !client.closeFlag && client.closeChan != nil {
+		close(client.closeChan)
+	}
 	client.closeFlag = true
 	for conn := range client.conns {
 		conn.Close()
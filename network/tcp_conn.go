@@ -4,6 +4,7 @@ import (
 	"github.com/name5566/leaf/log"
 	"net"
 	"sync"
+	"time"
 )
 
 type ConnSet map[net.Conn]struct{}
@@ -14,13 +15,22 @@ type TCPConn struct {
 	writeChan chan []byte
 	closeFlag bool
 	msgParser *MsgParser
+
+	// no timeout if 0
+	readIdleTimeout  time.Duration
+	writeIdleTimeout time.Duration
+
+	logger *log.Logger
 }
 
-func newTCPConn(conn net.Conn, pendingWriteNum int, msgParser *MsgParser) *TCPConn {
+func newTCPConn(conn net.Conn, pendingWriteNum int, msgParser *MsgParser, readIdleTimeout time.Duration, writeIdleTimeout time.Duration, logger *log.Logger) *TCPConn {
 	tcpConn := new(TCPConn)
 	tcpConn.conn = conn
 	tcpConn.writeChan = make(chan []byte, pendingWriteNum)
 	tcpConn.msgParser = msgParser
+	tcpConn.readIdleTimeout = readIdleTimeout
+	tcpConn.writeIdleTimeout = writeIdleTimeout
+	tcpConn.logger = logger
 
 	go func() {
 		for b := range tcpConn.writeChan {
@@ -28,6 +38,9 @@ func newTCPConn(conn net.Conn, pendingWriteNum int, msgParser *MsgParser) *TCPCo
 				break
 			}
 
+			if writeIdleTimeout > 0 {
+				conn.SetWriteDeadline(time.Now().Add(writeIdleTimeout))
+			}
 			_, err := conn.Write(b)
 			if err != nil {
 				break
@@ -73,7 +86,7 @@ func (tcpConn *TCPConn) Close() {
 
 func (tcpConn *TCPConn) doWrite(b []byte) {
 	if len(tcpConn.writeChan) == cap(tcpConn.writeChan) {
-		log.Debug("close conn: channel full")
+		tcpConn.logger.Debug("close conn: channel full")
 		tcpConn.doDestroy()
 		return
 	}
@@ -105,6 +118,9 @@ func (tcpConn *TCPConn) RemoteAddr() net.Addr {
 }
 
 func (tcpConn *TCPConn) ReadMsg() ([]byte, error) {
+	if tcpConn.readIdleTimeout > 0 {
+		tcpConn.conn.SetReadDeadline(time.Now().Add(tcpConn.readIdleTimeout))
+	}
 	return tcpConn.msgParser.Read(tcpConn)
 }
 
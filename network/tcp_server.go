@@ -1,6 +1,7 @@
 package network
 
 import (
+	"errors"
 	"github.com/name5566/leaf/log"
 	"net"
 	"sync"
@@ -12,11 +13,18 @@ type TCPServer struct {
 	MaxConnNum      int
 	PendingWriteNum int
 	NewAgent        func(*TCPConn) Agent
-	ln              net.Listener
-	conns           ConnSet
-	mutexConns      sync.Mutex
-	wgLn            sync.WaitGroup
-	wgConns         sync.WaitGroup
+	// the logger of the package log if nil
+	Logger     *log.Logger
+	ln         net.Listener
+	conns      ConnSet
+	mutexConns sync.Mutex
+	wgLn       sync.WaitGroup
+	wgConns    sync.WaitGroup
+
+	// the connection is closed if no message is read in ReadIdleTimeout or
+	// a write blocks for WriteIdleTimeout, no timeout if 0
+	ReadIdleTimeout  time.Duration
+	WriteIdleTimeout time.Duration
 
 	// msg parser
 	LenMsgLen    int
@@ -27,26 +35,39 @@ type TCPServer struct {
 }
 
 func (server *TCPServer) Start() {
-	server.init()
-	go server.run()
+	err := server.Listen()
+	if err != nil {
+		server.Logger.Fatal("%v", err)
+	}
 }
 
-func (server *TCPServer) init() {
-	ln, err := net.Listen("tcp", server.Addr)
+// the same as Start but returns an error if the server cannot listen
+func (server *TCPServer) Listen() error {
+	err := server.init()
 	if err != nil {
-		log.Fatal("%v", err)
+		return err
+	}
+
+	go server.run()
+	return nil
+}
+
+func (server *TCPServer) init() error {
+	if server.NewAgent == nil {
+		return errors.New("NewAgent must not be nil")
 	}
 
 	if server.MaxConnNum <= 0 {
 		server.MaxConnNum = 100
-		log.Release("invalid MaxConnNum, reset to %v", server.MaxConnNum)
+		server.Logger.Release("invalid MaxConnNum, reset to %v", server.MaxConnNum)
 	}
 	if server.PendingWriteNum <= 0 {
 		server.PendingWriteNum = 100
-		log.Release("invalid PendingWriteNum, reset to %v", server.PendingWriteNum)
+		server.Logger.Release("invalid PendingWriteNum, reset to %v", server.PendingWriteNum)
 	}
-	if server.NewAgent == nil {
-		log.Fatal("NewAgent must not be nil")
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
 	}
 
 	server.ln = ln
@@ -57,6 +78,7 @@ func (server *TCPServer) init() {
 	msgParser.SetMsgLen(server.LenMsgLen, server.MinMsgLen, server.MaxMsgLen)
 	msgParser.SetByteOrder(server.LittleEndian)
 	server.msgParser = msgParser
+	return nil
 }
 
 func (server *TCPServer) run() {
@@ -76,7 +98,7 @@ func (server *TCPServer) run() {
 				if max := 1 * time.Second; tempDelay > max {
 					tempDelay = max
 				}
-				log.Release("accept error: %v; retrying in %v", err, tempDelay)
+				server.Logger.Release("accept error: %v; retrying in %v", err, tempDelay)
 				time.Sleep(tempDelay)
 				continue
 			}
@@ -88,7 +110,7 @@ func (server *TCPServer) run() {
 		if len(server.conns) >= server.MaxConnNum {
 			server.mutexConns.Unlock()
 			conn.Close()
-			log.Debug("too many connections")
+			server.Logger.Debug("too many connections")
 			continue
 		}
 		server.conns[conn] = struct{}{}
@@ -96,7 +118,7 @@ func (server *TCPServer) run() {
 
 		server.wgConns.Add(1)
 
-		tcpConn := newTCPConn(conn, server.PendingWriteNum, server.msgParser)
+		tcpConn := newTCPConn(conn, server.PendingWriteNum, server.msgParser, server.ReadIdleTimeout, server.WriteIdleTimeout, server.Logger)
 		agent := server.NewAgent(tcpConn)
 		go func() {
 			agent.Run()
@@ -113,6 +135,20 @@ func (server *TCPServer) run() {
 	}
 }
 
+// the established connections are kept
+// goroutine safe
+func (server *TCPServer) SetMaxConnNum(n int) {
+	server.mutexConns.Lock()
+	server.MaxConnNum = n
+	server.mutexConns.Unlock()
+}
+
+// stops accepting connections, the established ones are kept
+func (server *TCPServer) CloseListener() {
+	server.ln.Close()
+	server.wgLn.Wait()
+}
+
 func (server *TCPServer) Close() {
 	server.ln.Close()
 	server.wgLn.Wait()
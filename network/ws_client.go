@@ -17,10 +17,12 @@ type WSClient struct {
 	HandshakeTimeout time.Duration
 	AutoReconnect    bool
 	NewAgent         func(*WSConn) Agent
-	dialer           websocket.Dialer
-	conns            WebsocketConnSet
-	wg               sync.WaitGroup
-	closeFlag        bool
+	// the logger of the package log if nil
+	Logger    *log.Logger
+	dialer    websocket.Dialer
+	conns     WebsocketConnSet
+	wg        sync.WaitGroup
+	closeFlag bool
 }
 
 func (client *WSClient) Start() {
@@ -38,29 +40,29 @@ func (client *WSClient) init() {
 
 	if client.ConnNum <= 0 {
 		client.ConnNum = 1
-		log.Release("invalid ConnNum, reset to %v", client.ConnNum)
+		client.Logger.Release("invalid ConnNum, reset to %v", client.ConnNum)
 	}
 	if client.ConnectInterval <= 0 {
 		client.ConnectInterval = 3 * time.Second
-		log.Release("invalid ConnectInterval, reset to %v", client.ConnectInterval)
+		client.Logger.Release("invalid ConnectInterval, reset to %v", client.ConnectInterval)
 	}
 	if client.PendingWriteNum <= 0 {
 		client.PendingWriteNum = 100
-		log.Release("invalid PendingWriteNum, reset to %v", client.PendingWriteNum)
+		client.Logger.Release("invalid PendingWriteNum, reset to %v", client.PendingWriteNum)
 	}
 	if client.MaxMsgLen <= 0 {
 		client.MaxMsgLen = 4096
-		log.Release("invalid MaxMsgLen, reset to %v", client.MaxMsgLen)
+		client.Logger.Release("invalid MaxMsgLen, reset to %v", client.MaxMsgLen)
 	}
 	if client.HandshakeTimeout <= 0 {
 		client.HandshakeTimeout = 10 * time.Second
-		log.Release("invalid HandshakeTimeout, reset to %v", client.HandshakeTimeout)
+		client.Logger.Release("invalid HandshakeTimeout, reset to %v", client.HandshakeTimeout)
 	}
 	if client.NewAgent == nil {
-		log.Fatal("NewAgent must not be nil")
+		client.Logger.Fatal("NewAgent must not be nil")
 	}
 	if client.conns != nil {
-		log.Fatal("client is running")
+		client.Logger.Fatal("client is running")
 	}
 
 	client.conns = make(WebsocketConnSet)
@@ -77,7 +79,7 @@ func (client *WSClient) dial() *websocket.Conn {
 			return conn
 		}
 
-		log.Release("connect to %v error: %v", client.Addr, err)
+		client.Logger.Release("connect to %v error: %v", client.Addr, err)
 		time.Sleep(client.ConnectInterval)
 		continue
 	}
@@ -102,7 +104,7 @@ reconnect:
 	client.conns[conn] = struct{}{}
 	client.Unlock()
 
-	wsConn := newWSConn(conn, client.PendingWriteNum, client.MaxMsgLen)
+	wsConn := newWSConn(conn, client.PendingWriteNum, client.MaxMsgLen, 0, 0, client.Logger)
 	agent := client.NewAgent(wsConn)
 	agent.Run()
 
@@ -6,6 +6,7 @@ import (
 	"github.com/name5566/leaf/log"
 	"net"
 	"sync"
+	"time"
 )
 
 type WebsocketConnSet map[*websocket.Conn]struct{}
@@ -16,13 +17,22 @@ type WSConn struct {
 	writeChan chan []byte
 	maxMsgLen uint32
 	closeFlag bool
+
+	// no timeout if 0
+	readIdleTimeout  time.Duration
+	writeIdleTimeout time.Duration
+
+	logger *log.Logger
 }
 
-func newWSConn(conn *websocket.Conn, pendingWriteNum int, maxMsgLen uint32) *WSConn {
+func newWSConn(conn *websocket.Conn, pendingWriteNum int, maxMsgLen uint32, readIdleTimeout time.Duration, writeIdleTimeout time.Duration, logger *log.Logger) *WSConn {
 	wsConn := new(WSConn)
 	wsConn.conn = conn
 	wsConn.writeChan = make(chan []byte, pendingWriteNum)
 	wsConn.maxMsgLen = maxMsgLen
+	wsConn.readIdleTimeout = readIdleTimeout
+	wsConn.writeIdleTimeout = writeIdleTimeout
+	wsConn.logger = logger
 
 	go func() {
 		for b := range wsConn.writeChan {
@@ -30,6 +40,9 @@ func newWSConn(conn *websocket.Conn, pendingWriteNum int, maxMsgLen uint32) *WSC
 				break
 			}
 
+			if writeIdleTimeout > 0 {
+				conn.SetWriteDeadline(time.Now().Add(writeIdleTimeout))
+			}
 			err := conn.WriteMessage(websocket.BinaryMessage, b)
 			if err != nil {
 				break
@@ -75,7 +88,7 @@ func (wsConn *WSConn) Close() {
 
 func (wsConn *WSConn) doWrite(b []byte) {
 	if len(wsConn.writeChan) == cap(wsConn.writeChan) {
-		log.Debug("close conn: channel full")
+		wsConn.logger.Debug("close conn: channel full")
 		wsConn.doDestroy()
 		return
 	}
@@ -93,6 +106,9 @@ func (wsConn *WSConn) RemoteAddr() net.Addr {
 
 // goroutine not safe
 func (wsConn *WSConn) ReadMsg() ([]byte, error) {
+	if wsConn.readIdleTimeout > 0 {
+		wsConn.conn.SetReadDeadline(time.Now().Add(wsConn.readIdleTimeout))
+	}
 	_, b, err := wsConn.conn.ReadMessage()
 	return b, err
 }
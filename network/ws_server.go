@@ -2,6 +2,7 @@ package network
 
 import (
 	"crypto/tls"
+	"errors"
 	"github.com/gorilla/websocket"
 	"github.com/name5566/leaf/log"
 	"net"
@@ -19,8 +20,15 @@ type WSServer struct {
 	CertFile        string
 	KeyFile         string
 	NewAgent        func(*WSConn) Agent
-	ln              net.Listener
-	handler         *WSHandler
+	// the logger of the package log if nil
+	Logger  *log.Logger
+	ln      net.Listener
+	handler *WSHandler
+
+	// the connection is closed if no message is read in ReadIdleTimeout or
+	// a write blocks for WriteIdleTimeout, no timeout if 0
+	ReadIdleTimeout  time.Duration
+	WriteIdleTimeout time.Duration
 }
 
 type WSHandler struct {
@@ -32,6 +40,10 @@ type WSHandler struct {
 	conns           WebsocketConnSet
 	mutexConns      sync.Mutex
 	wg              sync.WaitGroup
+
+	readIdleTimeout  time.Duration
+	writeIdleTimeout time.Duration
+	logger           *log.Logger
 }
 
 func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -41,7 +53,7 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	conn, err := handler.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Debug("upgrade error: %v", err)
+		handler.logger.Debug("upgrade error: %v", err)
 		return
 	}
 	conn.SetReadLimit(int64(handler.maxMsgLen))
@@ -58,13 +70,13 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if len(handler.conns) >= handler.maxConnNum {
 		handler.mutexConns.Unlock()
 		conn.Close()
-		log.Debug("too many connections")
+		handler.logger.Debug("too many connections")
 		return
 	}
 	handler.conns[conn] = struct{}{}
 	handler.mutexConns.Unlock()
 
-	wsConn := newWSConn(conn, handler.pendingWriteNum, handler.maxMsgLen)
+	wsConn := newWSConn(conn, handler.pendingWriteNum, handler.maxMsgLen, handler.readIdleTimeout, handler.writeIdleTimeout, handler.logger)
 	agent := handler.newAgent(wsConn)
 	agent.Run()
 
@@ -77,40 +89,48 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (server *WSServer) Start() {
-	ln, err := net.Listen("tcp", server.Addr)
+	err := server.Listen()
 	if err != nil {
-		log.Fatal("%v", err)
+		server.Logger.Fatal("%v", err)
+	}
+}
+
+// the same as Start but returns an error if the server cannot listen
+func (server *WSServer) Listen() error {
+	if server.NewAgent == nil {
+		return errors.New("NewAgent must not be nil")
 	}
 
 	if server.MaxConnNum <= 0 {
 		server.MaxConnNum = 100
-		log.Release("invalid MaxConnNum, reset to %v", server.MaxConnNum)
+		server.Logger.Release("invalid MaxConnNum, reset to %v", server.MaxConnNum)
 	}
 	if server.PendingWriteNum <= 0 {
 		server.PendingWriteNum = 100
-		log.Release("invalid PendingWriteNum, reset to %v", server.PendingWriteNum)
+		server.Logger.Release("invalid PendingWriteNum, reset to %v", server.PendingWriteNum)
 	}
 	if server.MaxMsgLen <= 0 {
 		server.MaxMsgLen = 4096
-		log.Release("invalid MaxMsgLen, reset to %v", server.MaxMsgLen)
+		server.Logger.Release("invalid MaxMsgLen, reset to %v", server.MaxMsgLen)
 	}
 	if server.HTTPTimeout <= 0 {
 		server.HTTPTimeout = 10 * time.Second
-		log.Release("invalid HTTPTimeout, reset to %v", server.HTTPTimeout)
+		server.Logger.Release("invalid HTTPTimeout, reset to %v", server.HTTPTimeout)
 	}
-	if server.NewAgent == nil {
-		log.Fatal("NewAgent must not be nil")
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
 	}
 
 	if server.CertFile != "" || server.KeyFile != "" {
 		config := &tls.Config{}
 		config.NextProtos = []string{"http/1.1"}
 
-		var err error
 		config.Certificates = make([]tls.Certificate, 1)
 		config.Certificates[0], err = tls.LoadX509KeyPair(server.CertFile, server.KeyFile)
 		if err != nil {
-			log.Fatal("%v", err)
+			ln.Close()
+			return err
 		}
 
 		ln = tls.NewListener(ln, config)
@@ -118,11 +138,14 @@ func (server *WSServer) Start() {
 
 	server.ln = ln
 	server.handler = &WSHandler{
-		maxConnNum:      server.MaxConnNum,
-		pendingWriteNum: server.PendingWriteNum,
-		maxMsgLen:       server.MaxMsgLen,
-		newAgent:        server.NewAgent,
-		conns:           make(WebsocketConnSet),
+		maxConnNum:       server.MaxConnNum,
+		pendingWriteNum:  server.PendingWriteNum,
+		maxMsgLen:        server.MaxMsgLen,
+		newAgent:         server.NewAgent,
+		conns:            make(WebsocketConnSet),
+		readIdleTimeout:  server.ReadIdleTimeout,
+		writeIdleTimeout: server.WriteIdleTimeout,
+		logger:           server.Logger,
 		upgrader: websocket.Upgrader{
 			HandshakeTimeout: server.HTTPTimeout,
 			CheckOrigin:      func(_ *http.Request) bool { return true },
@@ -138,6 +161,20 @@ func (server *WSServer) Start() {
 	}
 
 	go httpServer.Serve(ln)
+	return nil
+}
+
+// the established connections are kept
+// goroutine safe
+func (server *WSServer) SetMaxConnNum(n int) {
+	server.handler.mutexConns.Lock()
+	server.handler.maxConnNum = n
+	server.handler.mutexConns.Unlock()
+}
+
+// stops accepting connections, the established ones are kept
+func (server *WSServer) CloseListener() {
+	server.ln.Close()
 }
 
 func (server *WSServer) Close() {
@@ -10,14 +10,22 @@ import (
 // one dispatcher per goroutine (goroutine not safe)
 type Dispatcher struct {
 	ChanTimer chan *Timer
+	closeSig  chan struct{}
 }
 
 func NewDispatcher(l int) *Dispatcher {
 	disp := new(Dispatcher)
 	disp.ChanTimer = make(chan *Timer, l)
+	disp.closeSig = make(chan struct{})
 	return disp
 }
 
+// the timers firing after Close are dropped rather than blocked on ChanTimer
+// which is no longer read
+func (disp *Dispatcher) Close() {
+	close(disp.closeSig)
+}
+
 // Timer
 type Timer struct {
 	t  *time.Timer
@@ -52,7 +60,10 @@ func (disp *Dispatcher) AfterFunc(d time.Duration, cb func()) *Timer {
 	t := new(Timer)
 	t.cb = cb
 	t.t = time.AfterFunc(d, func() {
-		disp.ChanTimer <- t
+		select {
+		case disp.ChanTimer <- t:
+		case <-disp.closeSig:
+		}
 	})
 	return t
 }